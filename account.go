@@ -0,0 +1,234 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.google.com/p/goauth2/oauth"
+	"code.google.com/p/google-api-go-client/mirror/v1"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/urlfetch"
+)
+
+const revokeEndpoint = "https://accounts.google.com/o/oauth2/revoke"
+
+// Because App Engine owns main and starts the HTTP service,
+// we do our setup during initialization.
+func init() {
+	http.HandleFunc("/deleteaccount", errorAdapter(authenticated(deleteAccountHandler)))
+}
+
+// deleteAccountHandler removes everything the app created for the user,
+// including timeline items, and signs them out.
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return nil
+	}
+	return signOut(w, r, "deleteAccount", true)
+}
+
+// signOut tears down the current user's account and ends their session. op
+// names the operation in the audit log.
+func signOut(w http.ResponseWriter, r *http.Request, op string, deleteItems bool) error {
+	c := newContext(r)
+	userId := currentUser(r)
+	start := time.Now()
+	e := &AuditEntry{Actor: userId, UserId: userId, Operation: op}
+	incomplete, err := teardownAccount(c, currentTransport(r), userId, deleteItems)
+	if err != nil {
+		audit(c, e, err, time.Since(start))
+		return wrapError(err, "Unable to remove the app from your Glass")
+	}
+	storeUserID(w, r, "")
+	if err = purgeUserData(c, userId); err != nil {
+		audit(c, e, err, time.Since(start))
+		return wrapError(err, "Unable to delete your data")
+	}
+	// The user is signed out even if their Glass couldn't be cleaned up
+	// completely, but the audit log says what was left.
+	audit(c, e, incomplete, time.Since(start))
+
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+// teardownAccount removes the subscriptions, contacts and optionally the
+// timeline items the app created on the user's Glass, then revokes the app's
+// access. Failures to clean up Glass don't stop the user from revoking access;
+// they are returned as incomplete.
+func teardownAccount(c appengine.Context, t *oauth.Transport, userId string, deleteItems bool) (incomplete, err error) {
+	svc, err := mirror.New(t.Client())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create Mirror service: %s", err)
+	}
+	var failures []string
+	if err = deleteSubscriptions(c, svc); err != nil {
+		c.Errorf("Unable to delete subscriptions: %s", err)
+		failures = append(failures, "subscriptions: "+err.Error())
+	}
+	if err = deleteContacts(c, svc); err != nil {
+		c.Errorf("Unable to delete contacts: %s", err)
+		failures = append(failures, "contacts: "+err.Error())
+	}
+	if deleteItems {
+		if err = deleteTimeline(c, svc, t.Client(), userId); err != nil {
+			c.Errorf("Unable to delete timeline items: %s", err)
+			failures = append(failures, "timeline: "+err.Error())
+		}
+	}
+	if err = revokeToken(c, t.Token); err != nil {
+		return nil, fmt.Errorf("Unable to revoke token: %s", err)
+	}
+	if failures != nil {
+		return fmt.Errorf("Unable to clean up %s", strings.Join(failures, "; ")), nil
+	}
+	return nil, nil
+}
+
+// deleteSubscriptions deletes all the app's subscriptions for the user.
+func deleteSubscriptions(c appengine.Context, svc *mirror.Service) error {
+	var subscriptions *mirror.SubscriptionsListResponse
+	err := mirrorCall(c, "subscriptions.list", func() (err error) {
+		subscriptions, err = svc.Subscriptions.List().Do()
+		return
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range subscriptions.Items {
+		err = mirrorCall(c, "subscriptions.delete", func() error {
+			return svc.Subscriptions.Delete(s.Id).Do()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteContacts deletes all the contacts the app inserted for the user.
+func deleteContacts(c appengine.Context, svc *mirror.Service) error {
+	var contacts *mirror.ContactsListResponse
+	err := mirrorCall(c, "contacts.list", func() (err error) {
+		contacts, err = svc.Contacts.List().Do()
+		return
+	})
+	if err != nil {
+		return err
+	}
+	for _, ct := range contacts.Items {
+		err = mirrorCall(c, "contacts.delete", func() error {
+			return svc.Contacts.Delete(ct.Id).Do()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTimeline deletes all the timeline items the app inserted for the user,
+// a page at a time in batch requests sent with client.
+func deleteTimeline(c appengine.Context, svc *mirror.Service, client *http.Client, userId string) error {
+	pageToken := ""
+	for {
+		var timelineItems *mirror.TimelineListResponse
+		err := mirrorCall(c, "timeline.list", func() (err error) {
+			timelineItems, err = svc.Timeline.List().PageToken(pageToken).Do()
+			return
+		})
+		if err != nil {
+			return err
+		}
+		calls := make([]*batchCall, len(timelineItems.Items))
+		for i, t := range timelineItems.Items {
+			calls[i] = &batchCall{UserId: userId, Method: "DELETE", Path: "timeline/" + t.Id}
+		}
+		for _, res := range mirrorBatch(c, client, calls) {
+			if res.Err != nil {
+				return res.Err
+			}
+		}
+		if pageToken = timelineItems.NextPageToken; pageToken == "" {
+			return nil
+		}
+	}
+}
+
+// revokeToken revokes the app's access to the user's account. A token Google
+// reports as invalid has already been revoked or has expired.
+func revokeToken(c appengine.Context, tok *oauth.Token) error {
+	token := tok.RefreshToken
+	if token == "" {
+		token = tok.AccessToken
+	}
+	client := urlfetch.Client(c)
+	resp, err := client.PostForm(revokeEndpoint, url.Values{"token": {token}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	e := struct {
+		Error string `json:"error"`
+	}{}
+	json.NewDecoder(resp.Body).Decode(&e)
+	if resp.StatusCode == http.StatusBadRequest && e.Error == "invalid_token" {
+		c.Infof("Token was already revoked")
+		return nil
+	}
+	return fmt.Errorf("Revocation returned %s: %s", resp.Status, e.Error)
+}
+
+// purgeUserData deletes everything stored for the user, except for the audit
+// log which is never modified and quota counters.
+func purgeUserData(c appengine.Context, userId string) error {
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "OAuth2Token", userId, 0, nil),
+		datastore.NewKey(c, "GrantedScopes", userId, 0, nil),
+		datastore.NewKey(c, "Onboarding", userId, 0, nil),
+	}
+	sessions, err := datastore.NewQuery("Session").Filter("UserId =", userId).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	// Quota counters are kept until they expire, or signing in again would
+	// reset the user's daily quota.
+	keys = append(keys, sessions...)
+	if err = datastore.DeleteMulti(c, keys); err != nil {
+		return err
+	}
+	if err = deleteUploads(c, userId); err != nil {
+		return err
+	}
+	if err = deleteContactPhotos(c, userId); err != nil {
+		return err
+	}
+	if err = deleteContactRoutes(c, userId); err != nil {
+		return err
+	}
+	invalidateDashboard(c, userId)
+	return deleteFlashes(c, userId)
+}
@@ -15,52 +15,265 @@
 package quickstart
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
 	"code.google.com/p/google-api-go-client/mirror/v1"
 
 	"appengine"
+	"appengine/memcache"
 )
 
+// Response headers passed through from the Mirror API when streaming an
+// attachment.
+var attachmentHeaders = []string{
+	"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified",
+}
+
+// cachedAttachment is the content of a small attachment, kept in memcache.
+type cachedAttachment struct {
+	ContentType string
+	Data        []byte
+}
+
 // Init HTTP handlers.
 func init() {
-	http.HandleFunc("/attachmentproxy", errorAdapter(attachmentProxyHandler))
+	http.HandleFunc("/attachmentproxy", instrumented("attachmentproxy", errorAdapter(sharedOrAuthenticated(attachmentProxyHandler))))
+}
+
+// attachmentHash identifies an attachment of the user in caches and ETags.
+func attachmentHash(userId, itemId, attachmentId string) string {
+	sum := sha256.Sum256([]byte(userId + "\x00" + itemId + "\x00" + attachmentId))
+	return hex.EncodeToString(sum[:])
+}
+
+// etagListed reports whether an If-None-Match header lists the ETag. Tags are
+// compared weakly, as If-None-Match requires, so W/ prefixes are ignored.
+func etagListed(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == etag {
+			return true
+		}
+	}
+	return false
 }
 
-// attachmentProxy returns the attachment for the current user using the IDs provided by the "timelineItem" and "attachment" form values.
+// notModified reports whether the client already has the version of the
+// attachment identified by etag. "*" only matches attachments that exist.
+func notModified(c appengine.Context, r *http.Request, etag, hash, itemId, attachmentId string) (bool, error) {
+	match := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if match != "*" {
+		return etagListed(match, etag), nil
+	}
+	if _, err := attachmentInfo(c, r, hash, itemId, attachmentId); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func attachmentDataKey(hash string) string {
+	return "attachment:data:" + hash
+}
+
+// attachmentProxy returns the attachment for the current user, or the user who
+// signed the link, using the IDs provided by the "timelineItem" and
+// "attachment" form values, or a thumbnail of it if a "size" is given.
+// Attachments never change, so their IDs make a strong ETag. Small attachments
+// are served from memcache with Range support; larger ones are streamed from
+// the API, passing Range requests through.
 func attachmentProxyHandler(w http.ResponseWriter, r *http.Request) error {
 	itemId := r.FormValue("timelineItem")
 	attachmentId := r.FormValue("attachment")
-	c := appengine.NewContext(r)
-	userId, err := userID(r)
-	if err != nil {
-		return err
+	c := newContext(r)
+	userId := currentUser(r)
+	if itemId == "" || attachmentId == "" {
+		return badRequest("Missing timeline item or attachment ID.")
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return &appError{http.StatusMethodNotAllowed, "Attachments can only be read.", nil}
+	}
+
+	hash := attachmentHash(userId, itemId, attachmentId)
+	h := w.Header()
+	h.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", attachmentMaxAge/time.Second))
+	if r.FormValue("size") != "" {
+		return serveThumbnail(w, r, hash, itemId, attachmentId)
 	}
-	t := authTransport(c, userId)
-	svc, err := mirror.New(t.Client())
+	etag := `"` + hash + `"`
+	h.Set("ETag", etag)
+	ok, err := notModified(c, r, etag, hash, itemId, attachmentId)
 	if err != nil {
 		return err
 	}
-	if itemId == "" || attachmentId == "" {
-		http.Error(w, "", http.StatusBadRequest)
+	if ok {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	dataKey := attachmentDataKey(hash)
+	cached := new(cachedAttachment)
+	if _, err := memcache.Gob.Get(c, dataKey, cached); err == nil {
+		h.Set("Content-Type", cached.ContentType)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(cached.Data))
 		return nil
 	}
-	a, err := svc.Timeline.Attachments.Get(itemId, attachmentId).Do()
+
+	a, err := attachmentInfo(c, r, hash, itemId, attachmentId)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("GET", a.ContentUrl, nil)
+	if a.IsProcessingContent {
+		// The content isn't final yet.
+		h.Del("ETag")
+		h.Set("Cache-Control", "no-cache")
+	}
+	req, err := http.NewRequest(r.Method, a.ContentUrl, nil)
 	if err != nil {
 		return err
 	}
-
-	resp, err := t.RoundTrip(req)
+	for _, k := range []string{"Range", "If-Range"} {
+		if v := r.Header.Get(k); v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	resp, err := currentTransport(r).RoundTrip(req)
 	if err != nil {
-		return err
+		return wrapError(err, "Unable to download the attachment")
 	}
 	defer resp.Body.Close()
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+	default:
+		return &appError{http.StatusBadGateway, "Unable to download the attachment.", fmt.Errorf("Attachment download returned %s", resp.Status)}
+	}
+
+	// Keep whole, small attachments for the next requests.
+	if r.Method == "GET" && resp.StatusCode == http.StatusOK && !a.IsProcessingContent &&
+		resp.ContentLength >= 0 && resp.ContentLength <= attachmentCacheMaxBytes {
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return wrapError(err, "Unable to download the attachment")
+		}
+		ct := resp.Header.Get("Content-Type")
+		item := &memcache.Item{
+			Key:        dataKey,
+			Object:     &cachedAttachment{ct, data},
+			Expiration: attachmentCacheExpiration,
+		}
+		if err := memcache.Gob.Set(c, item); err != nil {
+			c.Errorf("Unable to cache attachment: %v", err)
+		}
+		h.Set("Content-Type", ct)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		return nil
+	}
+
+	for _, k := range attachmentHeaders {
+		if v := resp.Header.Get(k); v != "" {
+			h.Set(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
 	return nil
 }
+
+// attachmentInfo returns the metadata of an attachment of the current user,
+// from memcache if possible. Attachments of items the user doesn't own aren't
+// found.
+func attachmentInfo(c appengine.Context, r *http.Request, hash, itemId, attachmentId string) (*mirror.Attachment, error) {
+	key := "attachment:info:" + hash
+	a := new(mirror.Attachment)
+	if _, err := memcache.Gob.Get(c, key, a); err == nil {
+		return a, nil
+	}
+	// Look the attachment up in the item rather than asking for it directly so
+	// that it is only found if the item belongs to the user and isn't deleted.
+	var item *mirror.TimelineItem
+	err := mirrorCall(c, "timeline.get", func() (err error) {
+		item, err = currentService(r).Timeline.Get(itemId).Do()
+		return
+	})
+	if err != nil {
+		return nil, wrapError(err, "Unable to retrieve the attachment")
+	}
+	a = nil
+	for _, ia := range item.Attachments {
+		if ia.Id == attachmentId {
+			a = ia
+		}
+	}
+	if a == nil || item.IsDeleted {
+		c.Warningf("User %s asked for attachment %s of item %s they don't own", currentUser(r), attachmentId, itemId)
+		return nil, &appError{http.StatusNotFound, "This attachment doesn't exist.", nil}
+	}
+	if !a.IsProcessingContent {
+		item := &memcache.Item{Key: key, Object: a, Expiration: attachmentCacheExpiration}
+		if err := memcache.Gob.Set(c, item); err != nil {
+			c.Errorf("Unable to cache attachment info: %v", err)
+		}
+	}
+	return a, nil
+}
+
+// attachmentContent returns the whole content of an attachment of the current
+// user, from memcache if possible. Small attachments are cached.
+func attachmentContent(c appengine.Context, r *http.Request, hash, itemId, attachmentId string) (*cachedAttachment, error) {
+	cached := new(cachedAttachment)
+	if _, err := memcache.Gob.Get(c, attachmentDataKey(hash), cached); err == nil {
+		return cached, nil
+	}
+	body, ct, err := openAttachment(c, r, hash, itemId, attachmentId)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(body, uploadMaxBytes+1))
+	if err != nil {
+		return nil, wrapError(err, "Unable to download the attachment")
+	}
+	if len(data) > uploadMaxBytes {
+		return nil, badRequest("The attachment is larger than %d MB.", uploadMaxBytes>>20)
+	}
+	cached = &cachedAttachment{ct, data}
+	if len(data) <= attachmentCacheMaxBytes {
+		item := &memcache.Item{Key: attachmentDataKey(hash), Object: cached, Expiration: attachmentCacheExpiration}
+		if err := memcache.Gob.Set(c, item); err != nil {
+			c.Errorf("Unable to cache attachment: %v", err)
+		}
+	}
+	return cached, nil
+}
+
+// openAttachment starts downloading an attachment of the current user from the
+// API. It returns the content, which the caller must close, and its type.
+func openAttachment(c appengine.Context, r *http.Request, hash, itemId, attachmentId string) (io.ReadCloser, string, error) {
+	a, err := attachmentInfo(c, r, hash, itemId, attachmentId)
+	if err != nil {
+		return nil, "", err
+	}
+	if a.IsProcessingContent {
+		return nil, "", &appError{http.StatusServiceUnavailable, "The attachment is still being processed, please try again later.", nil}
+	}
+	req, err := http.NewRequest("GET", a.ContentUrl, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := currentTransport(r).RoundTrip(req)
+	if err != nil {
+		return nil, "", wrapError(err, "Unable to download the attachment")
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", &appError{http.StatusBadGateway, "Unable to download the attachment.", fmt.Errorf("Attachment download returned %s", resp.Status)}
+	}
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
@@ -0,0 +1,237 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Actors of audited operations that aren't triggered by a signed-in user.
+const (
+	actorNotification = "notification"
+	actorTask         = "task"
+)
+
+// AuditEntry records an operation or a side effect of a notification. Entries
+// are only ever added, never updated or deleted.
+type AuditEntry struct {
+	Time          time.Time
+	Actor         string // User ID of whoever triggered the operation.
+	UserId        string // User ID whose Glass or data was affected.
+	Operation     string
+	Resources     []string `datastore:",noindex"` // IDs of the Mirror resources involved.
+	Result        string   // "ok" or "error".
+	Error         string   `datastore:",noindex"`
+	LatencyMillis int64
+	CorrelationId string // Ties the entry to the logs of the request.
+}
+
+// Keys of the audit details collected while handling a request.
+type auditKey int
+
+const (
+	auditResourcesKey auditKey = iota
+	auditErrorKey
+)
+
+var auditTmpl = template.Must(template.ParseFiles("audit.html"))
+
+// Because App Engine owns main and starts the HTTP service,
+// we do our setup during initialization.
+func init() {
+	http.HandleFunc("/admin/audit", errorAdapter(auditHandler))
+}
+
+// auditResource records the IDs of Mirror resources touched by the operation
+// being handled.
+func auditResource(r *http.Request, ids ...string) {
+	resources, _ := context.Get(r, auditResourcesKey).([]string)
+	context.Set(r, auditResourcesKey, append(resources, ids...))
+}
+
+// auditFailure records that the operation being handled failed.
+func auditFailure(r *http.Request, err error) {
+	context.Set(r, auditErrorKey, err)
+}
+
+// operationError returns the error recorded by the operation being handled, if
+// it failed.
+func operationError(r *http.Request) error {
+	err, _ := context.Get(r, auditErrorKey).(error)
+	return err
+}
+
+// auditOperation adds an entry for an operation run by the signed-in user,
+// using the details recorded on the request.
+func auditOperation(c appengine.Context, r *http.Request, userId, op string, latency time.Duration) {
+	resources, _ := context.Get(r, auditResourcesKey).([]string)
+	audit(c, &AuditEntry{
+		Actor:     userId,
+		UserId:    userId,
+		Operation: op,
+		Resources: resources,
+	}, operationError(r), latency)
+}
+
+// audit completes the entry with the outcome of the operation and stores it.
+func audit(c appengine.Context, e *AuditEntry, err error, latency time.Duration) {
+	e.Time = time.Now()
+	e.CorrelationId = contextCorrelationID(c)
+	e.LatencyMillis = int64(latency / time.Millisecond)
+	e.Result = "ok"
+	if err != nil {
+		e.Result = "error"
+		e.Error = err.Error()
+	}
+	key := datastore.NewIncompleteKey(c, "AuditEntry", nil)
+	if _, err := datastore.Put(c, key, e); err != nil {
+		c.Errorf("Unable to store audit entry: %v", err)
+	}
+}
+
+// auditQuery returns the query for the entries matching the "userId" and
+// "operation" filters of the request, most recent first. The "correlationId"
+// filter overrides the others.
+func auditQuery(r *http.Request) *datastore.Query {
+	q := datastore.NewQuery("AuditEntry").Order("-Time")
+	if id := r.FormValue("correlationId"); id != "" {
+		return q.Filter("CorrelationId =", id)
+	}
+	if u := r.FormValue("userId"); u != "" {
+		q = q.Filter("UserId =", u)
+	}
+	if op := r.FormValue("operation"); op != "" {
+		q = q.Filter("Operation =", op)
+	}
+	return q
+}
+
+// auditHandler lists audit entries, a page at a time, or exports the matching
+// entries as CSV or JSON lines depending on the "format" form value. Exports
+// hold at most auditExportMaxRows entries; the Link header of an export that
+// was cut short points to the next one.
+func auditHandler(w http.ResponseWriter, r *http.Request) error {
+	c := newContext(r)
+	q := auditQuery(r)
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		cur, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return nil
+		}
+		q = q.Start(cur)
+	}
+	format := r.FormValue("format")
+	limit := auditPageSize
+	if format == "csv" || format == "jsonl" {
+		limit = auditExportMaxRows
+	}
+	entries, next, err := auditEntries(c, q, limit)
+	if err != nil {
+		return fmt.Errorf("Unable to retrieve audit entries: %s", err)
+	}
+	if format == "csv" || format == "jsonl" {
+		if next != "" {
+			u := *r.URL
+			v := u.Query()
+			v.Set("cursor", next)
+			u.RawQuery = v.Encode()
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, u.String()))
+		}
+		if format == "csv" {
+			return exportAuditCSV(w, entries)
+		}
+		return exportAuditJSONL(w, entries)
+	}
+	return auditTmpl.Execute(w, map[string]interface{}{
+		"Entries":       entries,
+		"UserId":        r.FormValue("userId"),
+		"Operation":     r.FormValue("operation"),
+		"CorrelationId": r.FormValue("correlationId"),
+		"Next":          next,
+		"ExportMaxRows": auditExportMaxRows,
+	})
+}
+
+// auditEntries returns at most limit entries matching q, and the cursor of the
+// next ones if there may be more.
+func auditEntries(c appengine.Context, q *datastore.Query, limit int) ([]*AuditEntry, string, error) {
+	var entries []*AuditEntry
+	i := q.Limit(limit).Run(c)
+	for {
+		e := new(AuditEntry)
+		if _, err := i.Next(e); err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, e)
+	}
+	next := ""
+	if len(entries) == limit {
+		if cur, err := i.Cursor(); err == nil {
+			next = cur.String()
+		}
+	}
+	return entries, next, nil
+}
+
+// exportAuditCSV writes the entries as CSV.
+func exportAuditCSV(w http.ResponseWriter, entries []*AuditEntry) error {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=audit.csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "actor", "userId", "operation", "resources", "result", "error", "latencyMillis", "correlationId"})
+	for _, e := range entries {
+		cw.Write([]string{
+			e.Time.Format(time.RFC3339),
+			e.Actor,
+			e.UserId,
+			e.Operation,
+			strings.Join(e.Resources, " "),
+			e.Result,
+			e.Error,
+			strconv.FormatInt(e.LatencyMillis, 10),
+			e.CorrelationId,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportAuditJSONL writes the entries as one JSON object per line.
+func exportAuditJSONL(w http.ResponseWriter, entries []*AuditEntry) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=audit.jsonl")
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -15,134 +15,323 @@
 package quickstart
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"code.google.com/p/goauth2/oauth"
 	"code.google.com/p/google-api-go-client/mirror/v1"
 	"code.google.com/p/google-api-go-client/oauth2/v2"
+	"github.com/gorilla/context"
+	"github.com/gorilla/securecookie"
 
 	"appengine"
-	"appengine/urlfetch"
 )
 
-const revokeEndpointFmt = "https://accounts.google.com/o/oauth2/revoke?token=%s"
-
 // Because App Engine owns main and starts the HTTP service,
 // we do our setup during initialization.
 func init() {
-	http.HandleFunc("/auth", authHandler)
+	http.HandleFunc("/auth", errorAdapter(authHandler))
 	http.HandleFunc("/oauth2callback", errorAdapter(oauth2callbackHandler))
-	http.HandleFunc("/signout", errorAdapter(signoutHandler))
+	http.HandleFunc("/signout", errorAdapter(authenticated(signoutHandler)))
+}
+
+// Keys of the signed-in user's details in the request context.
+type authKey int
+
+const (
+	userIdKey authKey = iota
+	transportKey
+	serviceKey
+)
+
+// An authorization in progress is tied to the browser by a nonce, sent to
+// Google as the OAuth state and kept in a short-lived signed cookie rather
+// than a session so that anonymous visits store nothing. The form of the
+// operation to resume once the user has granted the scope it needs is kept
+// in their session.
+const (
+	oauthStateCookie    = "oauth-state"
+	pendingOperationKey = "pendingOperation"
+)
+
+// authStateCodec returns the codec signing OAuth state cookies.
+func authStateCodec(c appengine.Context) (*securecookie.SecureCookie, error) {
+	key, err := appKey(c, "session")
+	if err != nil {
+		return nil, err
+	}
+	return securecookie.New(key, nil).MaxAge(int(authStateMaxAge / time.Second)), nil
+}
+
+// setAuthStateCookie writes the OAuth state cookie, or deletes it if the
+// value is empty.
+func setAuthStateCookie(w http.ResponseWriter, r *http.Request, value string) {
+	o := sessionOptions(r)
+	o.MaxAge = int(authStateMaxAge / time.Second)
+	if value == "" {
+		o.MaxAge = -1
+	}
+	setSessionCookie(w, oauthStateCookie, value, o)
+}
+
+// authenticated wraps a handler that requires a signed-in user. It resolves
+// the user, refreshes their credentials if needed and puts them and their
+// Mirror service in the request context. Pages redirect users who aren't
+// signed in to /auth, other requests get a 401. It must run inside
+// errorAdapter, which clears the context.
+func authenticated(f func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		userId, err := userID(r)
+		if err != nil {
+			return wrapError(err, "Unable to retrieve your session")
+		}
+		if userId == "" {
+			return notSignedIn(w, r)
+		}
+		ok, err := loadCurrentUser(r, userId)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return notSignedIn(w, r)
+		}
+		return f(w, r)
+	}
+}
+
+// loadCurrentUser retrieves the user's credentials, refreshing them if needed,
+// and puts them and the user's Mirror service in the request context. It
+// returns false if the user has no valid credentials.
+func loadCurrentUser(r *http.Request, userId string) (bool, error) {
+	c := newContext(r)
+	t := authTransport(c, userId)
+	if t == nil {
+		return false, nil
+	}
+	if t.Expired() {
+		if err := t.Refresh(); err != nil {
+			c.Warningf("Unable to refresh credentials: %s", err)
+			refreshFailures.inc(c)
+			return false, nil
+		}
+		if err := storeCredential(c, userId, t.Token); err != nil {
+			c.Errorf("Unable to store credentials: %s", err)
+		}
+	}
+	svc, err := mirror.New(t.Client())
+	if err != nil {
+		return false, wrapError(err, "Unable to create Mirror service")
+	}
+	setCurrentUser(r, userId, t, svc)
+	return true, nil
+}
+
+// notSignedIn sends the user to sign in if the request is for a page, and
+// fails with a 401 otherwise.
+func notSignedIn(w http.ResponseWriter, r *http.Request) error {
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/auth", http.StatusFound)
+		return nil
+	}
+	return &appError{http.StatusUnauthorized, "Please sign in.", nil}
+}
+
+// setCurrentUser stores the signed-in user's details in the request context.
+func setCurrentUser(r *http.Request, userId string, t *oauth.Transport, svc *mirror.Service) {
+	context.Set(r, userIdKey, userId)
+	context.Set(r, transportKey, t)
+	context.Set(r, serviceKey, svc)
+}
+
+// currentUser returns the ID of the user signed in for a request handled by
+// authenticated.
+func currentUser(r *http.Request) string {
+	userId, _ := context.Get(r, userIdKey).(string)
+	return userId
+}
+
+// currentTransport returns the credentials of the user signed in for a
+// request handled by authenticated.
+func currentTransport(r *http.Request) *oauth.Transport {
+	t, _ := context.Get(r, transportKey).(*oauth.Transport)
+	return t
+}
+
+// currentService returns the Mirror service of the user signed in for a
+// request handled by authenticated.
+func currentService(r *http.Request) *mirror.Service {
+	svc, _ := context.Get(r, serviceKey).(*mirror.Service)
+	return svc
 }
 
 // auth is the HTTP handler that redirects the user to authenticate
-// with OAuth.
-func authHandler(w http.ResponseWriter, r *http.Request) {
-	url := config(r.Host).AuthCodeURL(r.URL.RawQuery)
+// with OAuth. An optional "scope" form value requests one of the incremental
+// scopes on top of the ones already granted. A random nonce is kept in a
+// signed cookie and sent as the OAuth state so that the callback only accepts
+// authorizations started here, in this browser.
+func authHandler(w http.ResponseWriter, r *http.Request) error {
+	c := newContext(r)
+	cfg := config(r.Host)
+	if s, ok := incrementalScopes[r.FormValue("scope")]; ok {
+		cfg.Scope = s
+	}
+	// Only force the consent screen when we don't already hold a refresh
+	// token for the user.
+	if userId, _ := userID(r); userId != "" {
+		if t := authTransport(c, userId); t != nil && t.RefreshToken != "" {
+			cfg.ApprovalPrompt = "auto"
+		}
+	}
+	nonce, err := newSessionID()
+	if err != nil {
+		return wrapError(err, "Unable to start signing you in")
+	}
+	codec, err := authStateCodec(c)
+	if err != nil {
+		return wrapError(err, "Unable to start signing you in")
+	}
+	encoded, err := codec.Encode(oauthStateCookie, nonce)
+	if err != nil {
+		return wrapError(err, "Unable to start signing you in")
+	}
+	setAuthStateCookie(w, r, encoded)
+	url := cfg.AuthCodeURL(nonce) + "&include_granted_scopes=true"
 	http.Redirect(w, r, url, http.StatusFound)
+	return nil
+}
+
+// takeAuthState removes the OAuth state cookie and the pending operation from
+// the session. It fails if the state doesn't match the cookie's nonce.
+func takeAuthState(w http.ResponseWriter, r *http.Request, state string) (url.Values, error) {
+	expired := &appError{http.StatusBadRequest, "This sign-in link has expired, please try again.", nil}
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil {
+		return nil, expired
+	}
+	codec, err := authStateCodec(newContext(r))
+	if err != nil {
+		return nil, err
+	}
+	var nonce string
+	if err = codec.Decode(oauthStateCookie, cookie.Value, &nonce); err != nil || nonce == "" ||
+		subtle.ConstantTimeCompare([]byte(nonce), []byte(state)) != 1 {
+		return nil, expired
+	}
+	setAuthStateCookie(w, r, "")
+
+	// Only users who were signed in have a pending operation.
+	session, err := store.Get(r, sessionName)
+	if err != nil || session.IsNew {
+		return nil, err
+	}
+	pending, _ := session.Values[pendingOperationKey].(string)
+	if pending == "" {
+		return nil, nil
+	}
+	delete(session.Values, pendingOperationKey)
+	if err = session.Save(r, w); err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(pending)
 }
 
 // oauth2callback is the handler to which Google's OAuth service redirects the
 // user after they have granted the appropriate permissions.
 func oauth2callbackHandler(w http.ResponseWriter, r *http.Request) error {
-	c := appengine.NewContext(r)
+	c := newContext(r)
+
+	pending, err := takeAuthState(w, r, r.FormValue("state"))
+	if err != nil {
+		return err
+	}
 
 	// Create an oauth transport with a urlfetch.Transport embedded inside.
 	t := &oauth.Transport{
 		Config:    config(r.Host),
-		Transport: &urlfetch.Transport{Context: c},
+		Transport: newTransport(c, ""),
 	}
 
 	// Exchange the code for access and refresh tokens.
 	tok, err := t.Exchange(r.FormValue("code"))
 	if err != nil {
-		return fmt.Errorf("Exchange(%q): %v", r.FormValue("code"), err)
+		return &appError{http.StatusUnauthorized, "Unable to sign you in, please try again.", err}
 	}
 
 	o, err := oauth2.New(t.Client())
 	if err != nil {
-		return fmt.Errorf("Unable to instantiate UserInfo service: %s", err)
+		return wrapError(err, "Unable to instantiate UserInfo service")
 	}
-	u, err := o.Userinfo.Get().Do()
+	var u *oauth2.Userinfoplus
+	err = mirrorCall(c, "userinfo.get", func() (err error) {
+		u, err = o.Userinfo.Get().Do()
+		return
+	})
 	if err != nil {
-		return fmt.Errorf("Unable to retrieve user ID: %s", err)
+		return wrapError(err, "Unable to retrieve your profile")
 	}
 
 	userId := fmt.Sprintf("%s_%s", strings.Split(clientId, ".")[0], u.Id)
 
+	// Google only returns a refresh token the first time the user consents;
+	// keep the one we already have otherwise.
+	existing := authTransport(c, userId)
+	if tok.RefreshToken == "" && existing != nil {
+		tok.RefreshToken = existing.RefreshToken
+	}
+
 	if err = storeUserID(w, r, userId); err != nil {
-		return fmt.Errorf("Unable to store user ID: %s", err)
+		return wrapError(err, "Unable to store your session")
 	}
 
 	if err = storeCredential(c, userId, tok); err != nil {
-		return fmt.Errorf("Unable to store credentials: %s", err)
+		return wrapError(err, "Unable to store your credentials")
 	}
 
-	bootstrapUser(r, t.Client(), userId)
-	http.Redirect(w, r, "/", http.StatusFound)
-	return nil
-}
-
-// bootstrapUser sets up sharing contact and notificaiton for a new user.
-func bootstrapUser(r *http.Request, client *http.Client, userId string) {
-	c := appengine.NewContext(r)
-	m, _ := mirror.New(client)
-
-	if strings.HasPrefix(r.Host, "https://") {
-		s := &mirror.Subscription{
-			Collection:  "timeline",
-			UserToken:   userId,
-			CallbackUrl: fullURL(r.Host, "/notify"),
-		}
-		m.Subscriptions.Insert(s).Do()
+	granted, err := fetchGrantedScopes(c, tok.AccessToken)
+	if err != nil {
+		c.Errorf("Unable to retrieve granted scopes: %s", err)
+	} else if err = storeGrantedScopes(c, userId, granted); err != nil {
+		c.Errorf("Unable to store granted scopes: %s", err)
+	}
 
-		c := &mirror.Contact{
-			Id:          "Go_Quick_Start",
-			DisplayName: "Go Quick Start",
-			ImageUrls:   []string{fullURL(r.Host, "/static/images/gopher.png")},
+	if existing == nil {
+		if err = startOnboarding(c, r.Host, userId); err != nil {
+			c.Errorf("Unable to start onboarding: %s", err)
 		}
-		m.Contacts.Insert(c).Do()
-	} else {
-		c.Infof("Post auth tasks are not supported on staging.")
 	}
 
-	t := &mirror.TimelineItem{
-		Text:         "Welcome to the Go Quick Start",
-		Notification: &mirror.NotificationConfig{Level: "DEFAULT"},
+	// Resume the operation that required an incremental authorization. Only
+	// operations posted to the main page are pending, and only those that
+	// can't run without the scope are resumed.
+	if op := pending.Get("operation"); resumableOperations[op] {
+		if scope := requiredScope(pending); scope == "" {
+			c.Warningf("Operation %s doesn't need an incremental scope", op)
+		} else if !grantedScopes(c, userId)[scope] {
+			pushFlash(c, userId, flashWarning, "The requested permission was not granted.")
+		} else {
+			svc, err := mirror.New(t.Client())
+			if err != nil {
+				return wrapError(err, "Unable to create Mirror service")
+			}
+			r.Form = pending
+			setCurrentUser(r, userId, t, svc)
+			runOperation(c, r, svc, userId, op)
+		}
 	}
-
-	m.Timeline.Insert(t).Do()
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
 }
 
-// signout Revokes access for the user and removes the associated credentials from the datastore.
+// signout revokes access for the user, removes what the app set up on their
+// Glass and deletes their data. Timeline items are only deleted when the
+// "deleteItems" form value is set.
 func signoutHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != "POST" {
 		return nil
 	}
-	c := appengine.NewContext(r)
-	userId, err := userID(r)
-	if err != nil {
-		return fmt.Errorf("Unable to retrieve user ID: %s", err)
-	}
-	if userId == "" {
-		http.Redirect(w, r, "/auth", http.StatusFound)
-		return nil
-	}
-	t := authTransport(c, userId)
-	if t == nil {
-		http.Redirect(w, r, "/auth", http.StatusFound)
-		return nil
-	}
-	client := urlfetch.Client(c)
-	_, err = client.Get(fmt.Sprintf(revokeEndpointFmt, t.Token.RefreshToken))
-	if err != nil {
-		return fmt.Errorf("Unable to revoke token: %s", err)
-	}
-	storeUserID(w, r, "")
-	deleteCredential(c, userId)
-
-	http.Redirect(w, r, "/", http.StatusFound)
-	return nil
+	return signOut(w, r, "signOut", r.FormValue("deleteItems") == "on")
 }
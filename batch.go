@@ -0,0 +1,225 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+
+	"code.google.com/p/google-api-go-client/googleapi"
+
+	"appengine"
+)
+
+const (
+	batchEndpoint   = "https://www.googleapis.com/batch"
+	batchMirrorPath = "/mirror/v1/"
+)
+
+// batchCall is one Mirror API call sent as part of a batch request.
+type batchCall struct {
+	UserId string // User the call is made for, whose quota it is counted in.
+	Method string
+	Path   string      // Path relative to the Mirror API, e.g. "timeline/<id>".
+	Body   interface{} // Sent as JSON if not nil.
+	Header http.Header // Extra headers, e.g. another user's Authorization.
+}
+
+// batchResult is the outcome of a batchCall. Err is a *googleapi.Error when the
+// API rejected the call.
+type batchResult struct {
+	Body []byte
+	Err  error
+}
+
+// decode decodes the JSON response of a successful call into v.
+func (r *batchResult) decode(v interface{}) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	return json.Unmarshal(r.Body, v)
+}
+
+// mirrorBatch sends the calls in batch requests of at most batchMaxCalls and
+// returns their results in the same order. Calls over quota are not sent. A
+// batch request that fails as a whole is retried like any other API call and,
+// if it still fails, its error is reported for each of its calls.
+func mirrorBatch(c appengine.Context, client *http.Client, calls []*batchCall) []*batchResult {
+	if len(calls) == 0 {
+		return nil
+	}
+	results := make([]*batchResult, len(calls))
+	var allowed []int
+	for i, call := range calls {
+		if err := chargeQuota(c, call.UserId, mirrorOperation(call.Method, call.Path)); err != nil {
+			results[i] = &batchResult{Err: err}
+		} else {
+			allowed = append(allowed, i)
+		}
+	}
+	for start := 0; start < len(allowed); start += batchMaxCalls {
+		end := start + batchMaxCalls
+		if end > len(allowed) {
+			end = len(allowed)
+		}
+		chunk := make([]*batchCall, end-start)
+		for i, j := range allowed[start:end] {
+			chunk[i] = calls[j]
+		}
+		// Batches are only retried when none of their calls creates a
+		// resource.
+		op := "batch"
+		for _, call := range chunk {
+			if call.Method == "POST" {
+				op = "batch.insert"
+			}
+		}
+		var res []*batchResult
+		err := mirrorCall(c, op, func() (err error) {
+			res, err = sendBatch(client, chunk)
+			return
+		})
+		for i, j := range allowed[start:end] {
+			if err != nil {
+				results[j] = &batchResult{Err: err}
+			} else {
+				results[j] = res[i]
+			}
+			code := "200"
+			if e, ok := results[j].Err.(*googleapi.Error); ok {
+				code = strconv.Itoa(e.Code)
+			} else if results[j].Err != nil {
+				code = "error"
+			}
+			countMirrorCall(c, mirrorOperation(calls[j].Method, calls[j].Path), code)
+		}
+		if err != nil {
+			c.Errorf("Batch request failed: %s", err)
+		}
+	}
+	return results
+}
+
+// sendBatch sends the calls in a single multipart/mixed batch request.
+func sendBatch(client *http.Client, calls []*batchCall) ([]*batchResult, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, call := range calls {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", "application/http")
+		h.Set("Content-ID", fmt.Sprintf("<item%d>", i))
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		if err = writeBatchCall(pw, call); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", batchEndpoint, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err = googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	return readBatchResponse(resp, len(calls))
+}
+
+// writeBatchCall writes the HTTP request of a call in a batch part.
+func writeBatchCall(w io.Writer, call *batchCall) error {
+	var payload []byte
+	if call.Body != nil {
+		var err error
+		if payload, err = json.Marshal(call.Body); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "%s %s%s HTTP/1.1\r\n", call.Method, batchMirrorPath, call.Path)
+	for k, vs := range call.Header {
+		for _, v := range vs {
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		}
+	}
+	if payload != nil {
+		fmt.Fprintf(w, "Content-Type: application/json\r\nContent-Length: %d\r\n", len(payload))
+	}
+	io.WriteString(w, "\r\n")
+	_, err := w.Write(payload)
+	return err
+}
+
+// readBatchResponse parses the parts of a batch response, matching them to
+// calls by Content-ID.
+func readBatchResponse(resp *http.Response, n int) ([]*batchResult, error) {
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*batchResult, n)
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var i int
+		if _, err = fmt.Sscanf(part.Header.Get("Content-ID"), "<response-item%d>", &i); err != nil || i < 0 || i >= n {
+			continue
+		}
+		res, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			results[i] = &batchResult{Err: err}
+			continue
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			results[i] = &batchResult{Err: err}
+			continue
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		results[i] = &batchResult{Body: body, Err: googleapi.CheckResponse(res)}
+	}
+	for i, r := range results {
+		if r == nil {
+			results[i] = &batchResult{Err: errors.New("Missing from batch response")}
+		}
+	}
+	return results, nil
+}
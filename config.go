@@ -14,16 +14,141 @@
 
 package quickstart
 
+import "time"
+
 const (
-	debug       = true // Set to false to turn off logging every API request.
+	debug       = false // Set to true to log every API request, redacted.
 	sessionName = "mirror-go-quickstart"
-	secret      = "This should really be a secret." // Make it a random string
+
+	debugBodyLimit = 1024 // Bytes of each request and response body logged.
+
+	// Sessions end after this long without a request, or this long after
+	// sign-in, whichever comes first.
+	sessionIdleTimeout   = 2 * time.Hour
+	sessionMaxLifetime   = 14 * 24 * time.Hour
+	sessionTouchInterval = time.Minute // How often to record session activity.
+
+	// Users signing in must come back from Google's consent screen within this
+	// long, see authHandler.
+	authStateMaxAge = 10 * time.Minute
+
+	onboardingMaxAttempts = 5 // Attempts at each onboarding step before giving up.
+
+	// Retries of failed API calls, see mirrorCall.
+	mirrorCallDeadline  = 15 * time.Second // Deadline of a single API request.
+	retryMaxAttempts    = 4
+	retryInitialBackoff = 250 * time.Millisecond
+	retryMaxBackoff     = 4 * time.Second
+	retryBudget         = 30 * time.Second // Total time spent retrying a call.
+
+	batchMaxCalls = 50 // Calls sent in a single batch request.
+
+	// Daily limits of Mirror API calls, checked before each call. Keep them
+	// below the quota shown in the APIs console. Calls are counted in
+	// memcache and flushed to the datastore every minute.
+	quotaDailyLimit     = 1000000
+	quotaUserDailyLimit = 5000
+	quotaShards         = 20 // Shards of each counter, raise for more writes per second.
+	quotaRetention      = 7  // Days counters are kept for the quota dashboard.
+
+	auditPageSize      = 50   // Audit entries shown per page in the admin UI.
+	auditExportMaxRows = 5000 // Audit entries per CSV or JSON lines export.
+
+	// Main page data is fetched with these limits and cached for a while.
+	dashboardCallTimeout     = 5 * time.Second
+	dashboardCacheExpiration = 10 * time.Minute
+
+	// Limits of the media files uploaded with a card. Upload requests are
+	// cut at uploadMaxRequest, App Engine's own limit. Forms are parsed with
+	// that much memory because files that don't fit are spilled to temporary
+	// files, which App Engine can't write.
+	uploadMaxBytes   = 10 << 20
+	uploadMaxFiles   = 10
+	uploadMaxRequest = 32 << 20
+	uploadMaxMemory  = uploadMaxRequest
+
+	// Larger files are sent to the Mirror API with the resumable upload
+	// protocol, from a task, in chunks of resumableChunkSize which must be a
+	// multiple of 256 KB. The task hands over to a new one after
+	// resumableTaskBudget and gives up after resumableMaxAttempts failures.
+	resumableMaxBytes    = 30 << 20
+	resumableChunkSize   = 512 << 10
+	resumableTaskBudget  = 5 * time.Minute
+	resumableMaxAttempts = 5
+
+	// Limits of vCard files imported on /contacts. Photos embedded in them are
+	// stored in the datastore, so they must fit in an entity.
+	vcardMaxBytes        = 5 << 20
+	vcardMaxContacts     = 200
+	contactPhotoMaxBytes = 900 << 10
+
+	// Items shared with contacts are routed to pipelines. The archive keeps
+	// attachments of at most archiveMaxBytes, and webhooks get links to
+	// attachments valid for webhookLinkMaxAge.
+	archiveMaxBytes   = 900 << 10
+	webhookTimeout    = 10 * time.Second
+	webhookLinkMaxAge = 24 * time.Hour
+
+	// Limits of media fetched from URLs given by users, in addition to the
+	// upload limits. Files small enough to fit in memcache are cached.
+	mediaFetchTimeout      = 10 * time.Second
+	mediaFetchMaxRedirects = 3
+	mediaCacheMaxBytes     = 900 << 10
+	mediaCacheExpiration   = time.Hour
+
+	// Attachments are cached by browsers for attachmentMaxAge. Those small
+	// enough to fit in memcache are also cached by the app for a while.
+	attachmentMaxAge          = time.Hour
+	attachmentCacheMaxBytes   = 900 << 10
+	attachmentCacheExpiration = 5 * time.Minute
+
+	// Thumbnails are made of pictures of at most thumbnailMaxPixels, which
+	// take up to 4 bytes each once decoded, and kept in memcache much longer
+	// than attachments since they are small.
+	thumbnailMaxPixels       = 4 << 20
+	thumbnailQuality         = 85 // JPEG quality, from 1 to 100.
+	thumbnailCacheExpiration = 24 * time.Hour
+
+	// Links to attachments shared by users are valid for at most
+	// shareLinkMaxAge.
+	shareLinkMaxAge = 7 * 24 * time.Hour
+
+	// The gallery lists the attachments of at most galleryMaxItems timeline
+	// items. Zip downloads must fit in App Engine's 32 MB response limit.
+	galleryMaxItems         = 500
+	galleryDownloadMaxFiles = 50
+	galleryDownloadMaxBytes = 30 << 20
+
+	// Messages queued for a user beyond these are dropped, oldest first.
+	flashMaxMessages = 10
+	flashMaxAge      = 7 * 24 * time.Hour
+
+	// Bearer token Prometheus must send to scrape /metrics. Metrics can't be
+	// scraped until it is set.
+	metricsToken = "[[YOUR_METRICS_TOKEN]]"
 
 	// Created at http://code.google.com/apis/console, these identify
 	// our app for the OAuth protocol.
 	clientId     = "[[YOUR_CLIENT_ID]]"
 	clientSecret = "[[YOUR_CLIENT_SECRET]]"
-	scopes       = "https://www.googleapis.com/auth/glass.timeline " +
-		"https://www.googleapis.com/auth/glass.location " +
+
+	// Scopes requested at sign-in. Other scopes are requested incrementally
+	// the first time an operation needs them.
+	scopes = "https://www.googleapis.com/auth/glass.timeline " +
 		"https://www.googleapis.com/auth/userinfo.profile"
+	locationScope = "https://www.googleapis.com/auth/glass.location"
 )
+
+// Daily limits of specific Mirror API operations, as named by mirrorOperation.
+var quotaOperationLimits = map[string]int64{
+	"POST timeline":             100000,
+	"POST timeline.attachments": 20000,
+}
+
+// Largest width or height of each thumbnail size offered by the attachment
+// proxy.
+var thumbnailSizes = map[string]int{
+	"small":  150,
+	"medium": 300,
+	"large":  640,
+}
@@ -0,0 +1,270 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/google-api-go-client/mirror/v1"
+
+	"appengine"
+)
+
+// Values the Mirror API accepts for the contact fields edited on /contacts.
+var (
+	contactTypes           = []string{"INDIVIDUAL", "GROUP"}
+	contactCommands        = []string{"TAKE_A_NOTE", "POST_AN_UPDATE"}
+	contactSharingFeatures = []string{"ADD_CAPTION"}
+)
+
+var contactsTmpl = template.Must(template.ParseFiles("contacts.html"))
+
+// contactForm is a contact as shown in the contact form.
+type contactForm struct {
+	*mirror.Contact
+	Editing     bool
+	ImageUrls   string // One per line.
+	AcceptTypes string // Comma-separated.
+	Commands    map[string]bool
+	Features    map[string]bool
+}
+
+// newContactForm returns the form to edit the contact, or to create one if it
+// is nil.
+func newContactForm(ct *mirror.Contact) *contactForm {
+	f := &contactForm{
+		Contact:  ct,
+		Editing:  ct != nil,
+		Commands: make(map[string]bool),
+		Features: make(map[string]bool),
+	}
+	if ct == nil {
+		f.Contact = &mirror.Contact{Type: "INDIVIDUAL"}
+		return f
+	}
+	f.ImageUrls = strings.Join(ct.ImageUrls, "\n")
+	f.AcceptTypes = strings.Join(ct.AcceptTypes, ", ")
+	for _, cmd := range ct.AcceptCommands {
+		f.Commands[cmd.Type] = true
+	}
+	for _, s := range ct.SharingFeatures {
+		f.Features[s] = true
+	}
+	return f
+}
+
+// Because App Engine owns main and starts the HTTP service,
+// we do our setup during initialization.
+func init() {
+	http.HandleFunc("/contacts", instrumented("contacts", errorAdapter(authenticated(contactsHandler))))
+}
+
+// contactsHandler lists the user's contacts and their pipelines with a form to
+// create one, or to edit the one given by the "edit" form value along with its
+// pipeline. Operations posted to it are run like on the main page.
+func contactsHandler(w http.ResponseWriter, r *http.Request) error {
+	c := newContext(r)
+	userId, svc := currentUser(r), currentService(r)
+	if r.Method == "POST" {
+		runOperation(c, r, svc, userId, r.FormValue("operation"))
+		http.Redirect(w, r, "/contacts", http.StatusFound)
+		return nil
+	}
+
+	var contacts []*mirror.Contact
+	err := mirrorCall(c, "contacts.list", func() error {
+		l, err := svc.Contacts.List().Do()
+		if err == nil {
+			contacts = l.Items
+		}
+		return err
+	})
+	if err != nil {
+		return wrapError(err, "Unable to list your contacts")
+	}
+	routes, err := contactRoutes(c, userId)
+	if err != nil {
+		return wrapError(err, "Unable to retrieve the pipelines of your contacts")
+	}
+	var edit *mirror.Contact
+	var route *ContactRoute
+	if id := r.FormValue("edit"); id != "" {
+		for _, ct := range contacts {
+			if ct.Id == id {
+				edit = ct
+			}
+		}
+		if edit == nil {
+			return &appError{http.StatusNotFound, "This contact doesn't exist.", nil}
+		}
+		if route, err = contactRoute(c, userId, id); err != nil {
+			return wrapError(err, "Unable to retrieve the pipeline of the contact")
+		}
+	}
+	return contactsTmpl.Execute(w, struct {
+		Flashes         []*Flash
+		Contacts        []*mirror.Contact
+		Form            *contactForm
+		Types           []string
+		Commands        []string
+		SharingFeatures []string
+		Routes          map[string]*ContactRoute
+		Route           *ContactRoute // Of the contact being edited.
+		Pipelines       []*sharePipeline
+	}{userFlashes(c, userId), contacts, newContactForm(edit), contactTypes, contactCommands, contactSharingFeatures,
+		routes, route, pipelines})
+}
+
+// checkContactImage checks that the image can be shown for a contact and
+// returns its full URL. Glass downloads the image itself, so it must be one
+// we'd fetch too.
+func checkContactImage(c appengine.Context, host, imageUrl string) (string, error) {
+	if m, err := fetchMedia(c, host, imageUrl); err != nil {
+		return "", err
+	} else if !strings.HasPrefix(m.ContentType, "image/") {
+		return "", badRequest("The contact image must be a picture.")
+	}
+	if strings.HasPrefix(imageUrl, "/") {
+		imageUrl = fullURL(host, imageUrl)
+	}
+	return imageUrl, nil
+}
+
+// oneOf reports whether v is one of the values.
+func oneOf(v string, values []string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// readContactForm sets the fields of the contact form on the contact.
+func readContactForm(c appengine.Context, r *http.Request, ct *mirror.Contact) error {
+	if ct.DisplayName = strings.TrimSpace(r.FormValue("displayName")); ct.DisplayName == "" {
+		return badRequest("The contact needs a name.")
+	}
+	if ct.Type = r.FormValue("type"); !oneOf(ct.Type, contactTypes) {
+		return badRequest("Invalid contact type %q.", ct.Type)
+	}
+	ct.SpeakableName = strings.TrimSpace(r.FormValue("speakableName"))
+	ct.PhoneNumber = strings.TrimSpace(r.FormValue("phoneNumber"))
+
+	ct.ImageUrls = nil
+	for _, u := range strings.Fields(r.FormValue("imageUrls")) {
+		u, err := checkContactImage(c, r.Host, u)
+		if err != nil {
+			return err
+		}
+		ct.ImageUrls = append(ct.ImageUrls, u)
+	}
+	if len(ct.ImageUrls) == 0 {
+		return badRequest("The contact needs a picture.")
+	}
+
+	ct.AcceptTypes = nil
+	for _, t := range strings.Split(r.FormValue("acceptTypes"), ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if _, _, err := mime.ParseMediaType(t); err != nil || !strings.Contains(t, "/") {
+			return badRequest("%q is not a valid MIME type.", t)
+		}
+		ct.AcceptTypes = append(ct.AcceptTypes, t)
+	}
+
+	ct.AcceptCommands = nil
+	for _, t := range r.Form["acceptCommands"] {
+		if !oneOf(t, contactCommands) {
+			return badRequest("Invalid voice command %q.", t)
+		}
+		ct.AcceptCommands = append(ct.AcceptCommands, &mirror.Command{Type: t})
+	}
+	ct.SharingFeatures = nil
+	for _, s := range r.Form["sharingFeatures"] {
+		if !oneOf(s, contactSharingFeatures) {
+			return badRequest("Invalid sharing feature %q.", s)
+		}
+		ct.SharingFeatures = append(ct.SharingFeatures, s)
+	}
+
+	ct.Priority = 0
+	if p := r.FormValue("priority"); p != "" {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || n < 0 {
+			return badRequest("The priority must be a positive number.")
+		}
+		ct.Priority = n
+	}
+	return nil
+}
+
+// saveContact creates a contact from the contact form, or updates the one
+// given by the "editing" form value. Updates replace the whole contact rather
+// than patching it so that fields can be cleared; fields the form doesn't show
+// are kept.
+func saveContact(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
+	if id := r.FormValue("editing"); id != "" {
+		auditResource(r, id)
+		var ct *mirror.Contact
+		err := mirrorCall(c, "contacts.get", func() (err error) {
+			ct, err = svc.Contacts.Get(id).Do()
+			return
+		})
+		if err != nil {
+			return nil, wrapError(err, "Unable to retrieve the contact")
+		}
+		if err = readContactForm(c, r, ct); err != nil {
+			return nil, err
+		}
+		// The client library leaves out zero fields, so a priority set back
+		// to 0 would be dropped. Send the contact with it spelled out instead.
+		body := struct {
+			*mirror.Contact
+			Priority int64 `json:"priority"`
+		}{ct, ct.Priority}
+		call := &batchCall{UserId: currentUser(r), Method: "PUT", Path: "contacts/" + url.QueryEscape(id), Body: body}
+		if err = mirrorBatch(c, currentTransport(r).Client(), []*batchCall{call})[0].Err; err != nil {
+			return nil, wrapError(err, "Unable to update the contact")
+		}
+		return done("Updated contact: %s", ct.DisplayName), nil
+	}
+
+	ct := new(mirror.Contact)
+	if err := readContactForm(c, r, ct); err != nil {
+		return nil, err
+	}
+	ct.Id = strings.TrimSpace(r.FormValue("id"))
+	if ct.Id == "" {
+		ct.Id = ct.DisplayName
+	}
+	ct.Id = strings.Replace(ct.Id, " ", "_", -1)
+	auditResource(r, ct.Id)
+	err := mirrorCall(c, "contacts.insert", func() error {
+		_, err := svc.Contacts.Insert(ct).Do()
+		return err
+	})
+	if err != nil {
+		return nil, wrapError(err, "Unable to insert the contact")
+	}
+	return done("Inserted contact: %s", ct.DisplayName), nil
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"net/http"
+
+	"github.com/gorilla/context"
+
+	"appengine"
+	"appengine/taskqueue"
+)
+
+// correlationHeader carries the correlation ID to the tasks a request enqueues
+// and back to the client.
+const correlationHeader = "X-Correlation-Id"
+
+type correlationKey int
+
+const correlationIDKey correlationKey = 0
+
+// correlationID returns the ID tying together the log lines and audit entries
+// of the request and of the tasks it enqueued. Tasks keep the ID of the request
+// that enqueued them; any other request gets a new one.
+func correlationID(r *http.Request) string {
+	if id, ok := context.Get(r, correlationIDKey).(string); ok {
+		return id
+	}
+	// App Engine strips X-AppEngine-* headers from external requests, so only
+	// tasks can choose their ID.
+	id := r.Header.Get(correlationHeader)
+	if id == "" || r.Header.Get("X-AppEngine-TaskName") == "" {
+		id = newRequestID()
+	}
+	context.Set(r, correlationIDKey, id)
+	return id
+}
+
+// newContext returns the App Engine context of the request, logging with its
+// correlation ID.
+func newContext(r *http.Request) appengine.Context {
+	return &correlatedContext{appengine.NewContext(r), correlationID(r)}
+}
+
+// correlatedContext prefixes the lines it logs with a correlation ID.
+type correlatedContext struct {
+	appengine.Context
+	id string
+}
+
+func (c *correlatedContext) prefixed(format string, args []interface{}) (string, []interface{}) {
+	return "[%s] " + format, append([]interface{}{c.id}, args...)
+}
+
+func (c *correlatedContext) Debugf(format string, args ...interface{}) {
+	format, args = c.prefixed(format, args)
+	c.Context.Debugf(format, args...)
+}
+
+func (c *correlatedContext) Infof(format string, args ...interface{}) {
+	format, args = c.prefixed(format, args)
+	c.Context.Infof(format, args...)
+}
+
+func (c *correlatedContext) Warningf(format string, args ...interface{}) {
+	format, args = c.prefixed(format, args)
+	c.Context.Warningf(format, args...)
+}
+
+func (c *correlatedContext) Errorf(format string, args ...interface{}) {
+	format, args = c.prefixed(format, args)
+	c.Context.Errorf(format, args...)
+}
+
+func (c *correlatedContext) Criticalf(format string, args ...interface{}) {
+	format, args = c.prefixed(format, args)
+	c.Context.Criticalf(format, args...)
+}
+
+// contextCorrelationID returns the correlation ID of a context returned by
+// newContext, or "" for other contexts.
+func contextCorrelationID(c appengine.Context) string {
+	if cc, ok := c.(*correlatedContext); ok {
+		return cc.id
+	}
+	return ""
+}
+
+// addTask adds the task to the default queue, passing it the correlation ID of
+// the context.
+func addTask(c appengine.Context, t *taskqueue.Task) error {
+	if id := contextCorrelationID(c); id != "" {
+		if t.Header == nil {
+			t.Header = make(http.Header)
+		}
+		t.Header.Set(correlationHeader, id)
+	}
+	_, err := taskqueue.Add(c, t, "")
+	return err
+}
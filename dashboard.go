@@ -0,0 +1,123 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"net/http"
+	"sync"
+
+	"code.google.com/p/goauth2/oauth"
+	"code.google.com/p/google-api-go-client/googleapi"
+	"code.google.com/p/google-api-go-client/mirror/v1"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+// dashboard is the Mirror API data shown on the main page.
+type dashboard struct {
+	TimelineItems []*mirror.TimelineItem
+	Contact       *mirror.Contact // Nil if the user deleted it.
+	Subscriptions []*mirror.Subscription
+}
+
+func dashboardCacheKey(userId string) string {
+	return "dashboard:" + userId
+}
+
+// loadDashboard returns the user's dashboard from memcache, or fetches it from
+// the API with concurrent calls that each get dashboardCallTimeout, enforced
+// by urlfetch so that no call outlives the request. Calls aren't retried.
+// Parts that can't be fetched are left empty and a warning is returned for
+// each; the dashboard is only cached when complete.
+func loadDashboard(c appengine.Context, t *oauth.Transport, userId string) (*dashboard, []string) {
+	d := new(dashboard)
+	if _, err := memcache.Gob.Get(c, dashboardCacheKey(userId), d); err == nil {
+		return d, nil
+	}
+	client := (&oauth.Transport{
+		Config:    t.Config,
+		Token:     t.Token,
+		Transport: newDeadlineTransport(c, userId, dashboardCallTimeout),
+	}).Client()
+	svc, err := mirror.New(client)
+	if err != nil {
+		return d, []string{userMessage(wrapError(err, "Unable to create Mirror service"))}
+	}
+
+	fetches := []struct {
+		what string
+		call func() error
+	}{
+		{"your timeline", func() error {
+			l, err := svc.Timeline.List().MaxResults(3).Do()
+			if err == nil {
+				d.TimelineItems = l.Items
+			}
+			return err
+		}},
+		{"your contact", func() (err error) {
+			d.Contact, err = svc.Contacts.Get("Go_Quick_Start").Do()
+			if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+				return nil // The contact was deleted.
+			}
+			return
+		}},
+		{"your subscriptions", func() error {
+			l, err := svc.Subscriptions.List().Do()
+			if err == nil {
+				d.Subscriptions = l.Items
+			}
+			return err
+		}},
+	}
+	errs := make([]error, len(fetches))
+	var wg sync.WaitGroup
+	for i, f := range fetches {
+		wg.Add(1)
+		go func(i int, call func() error) {
+			defer wg.Done()
+			errs[i] = call()
+		}(i, f.call)
+	}
+	wg.Wait()
+
+	var warnings []string
+	for i, f := range fetches {
+		if err := errs[i]; err != nil {
+			c.Errorf("Unable to load %s: %s", f.what, err)
+			warnings = append(warnings, userMessage(wrapError(err, "Unable to load "+f.what)))
+		}
+	}
+	if warnings == nil {
+		item := &memcache.Item{
+			Key:        dashboardCacheKey(userId),
+			Object:     d,
+			Expiration: dashboardCacheExpiration,
+		}
+		if err := memcache.Gob.Set(c, item); err != nil {
+			c.Errorf("Unable to cache dashboard: %v", err)
+		}
+	}
+	return d, warnings
+}
+
+// invalidateDashboard drops the user's cached dashboard after the data it
+// shows has changed.
+func invalidateDashboard(c appengine.Context, userId string) {
+	if err := memcache.Delete(c, dashboardCacheKey(userId)); err != nil && err != memcache.ErrCacheMiss {
+		c.Errorf("Unable to invalidate dashboard: %v", err)
+	}
+}
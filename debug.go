@@ -0,0 +1,194 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"appengine"
+)
+
+const redacted = "[redacted]"
+
+// Fields holding credentials or personal data, in JSON and form bodies and in
+// query strings.
+var sensitiveFields = map[string]bool{
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"client_secret": true,
+	"code":          true,
+	"key":           true,
+	"Authorization": true,
+	"userToken":     true, // Secret identifying the user in notifications.
+	"verifyToken":   true,
+	"userId":        true,
+	"email":         true,
+	"name":          true,
+	"given_name":    true,
+	"family_name":   true,
+	"displayName":   true,
+	"speakableName": true,
+	"phoneNumber":   true,
+	"address":       true,
+	"latitude":      true,
+	"longitude":     true,
+	"text":          true,
+	"html":          true,
+	"speakableText": true,
+}
+
+// Matches a JSON string or number member, capturing its name.
+var jsonMember = regexp.MustCompile(`"(\w+)"(\s*:\s*)("(?:[^"\\]|\\.)*"|-?[0-9][0-9.eE+-]*)`)
+
+// debugTransport logs every request it sends and the response it gets, with
+// credentials and personal data redacted. Each request is given an ID that
+// ties its log lines together.
+type debugTransport struct {
+	Context   appengine.Context
+	Transport http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper. The request is copied to read its
+// body, since RoundTrippers must not modify it.
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.Context
+	id := newRequestID()
+	body, rc, err := debugBody(req.Header, req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rc != nil {
+		r := new(http.Request)
+		*r = *req
+		r.Body = rc
+		req = r
+	}
+	c.Infof("[%s] %s %s Authorization: %s\n%s", id, req.Method, redactURL(req.URL),
+		redactHeader(req.Header.Get("Authorization")), body)
+
+	start := time.Now()
+	resp, err := t.Transport.RoundTrip(req)
+	latency := time.Since(start)
+	if err != nil {
+		c.Infof("[%s] failed after %v: %v", id, latency, err)
+		return nil, err
+	}
+	if body, resp.Body, err = debugBody(resp.Header, resp.Body); err != nil {
+		return nil, err
+	}
+	c.Infof("[%s] %s in %v\n%s", id, resp.Status, latency, body)
+	return resp, nil
+}
+
+// newRequestID returns a random ID for the log lines of a request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// debugBody returns a redacted and truncated copy of a JSON or form body,
+// along with an unread copy of the body to send or return instead. Other
+// bodies, like media, are only described so that they don't have to be
+// buffered, and returned as is.
+func debugBody(h http.Header, body io.ReadCloser) (string, io.ReadCloser, error) {
+	if body == nil {
+		return "", nil, nil
+	}
+	ct, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if ct != "application/json" && ct != "application/x-www-form-urlencoded" {
+		return fmt.Sprintf("<%s body>", h.Get("Content-Type")), body, nil
+	}
+	b, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return "", nil, err
+	}
+	body = ioutil.NopCloser(bytes.NewReader(b))
+
+	var s string
+	if ct == "application/json" {
+		s = redactJSON(b)
+	} else {
+		s = redactForm(string(b))
+	}
+	if len(s) > debugBodyLimit {
+		// Don't cut a UTF-8 sequence in half.
+		n := debugBodyLimit
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = fmt.Sprintf("%s... (%d bytes)", s[:n], len(b))
+	}
+	return s, body, nil
+}
+
+// redactJSON replaces the values of sensitive members of a JSON document.
+func redactJSON(b []byte) string {
+	return jsonMember.ReplaceAllStringFunc(string(b), func(m string) string {
+		sub := jsonMember.FindStringSubmatch(m)
+		if !sensitiveFields[sub[1]] {
+			return m
+		}
+		return fmt.Sprintf(`"%s"%s"%s"`, sub[1], sub[2], redacted)
+	})
+}
+
+// redactForm replaces the values of sensitive fields of a URL-encoded form.
+func redactForm(s string) string {
+	v, err := url.ParseQuery(s)
+	if err != nil {
+		return redacted
+	}
+	for k := range v {
+		if sensitiveFields[k] {
+			v[k] = []string{redacted}
+		}
+	}
+	return v.Encode()
+}
+
+// redactURL returns the URL with the values of sensitive query parameters
+// replaced.
+func redactURL(u *url.URL) string {
+	r := *u
+	r.RawQuery = redactForm(u.RawQuery)
+	return r.String()
+}
+
+// redactHeader hides the credentials of an Authorization header, keeping the
+// scheme.
+func redactHeader(v string) string {
+	if v == "" {
+		return "none"
+	}
+	if i := strings.IndexByte(v, ' '); i >= 0 {
+		return v[:i] + " " + redacted
+	}
+	return redacted
+}
@@ -20,8 +20,33 @@ The main entry points are:
   * main.go: Displays the main page and handles requests from the main UI; this
              where most of the Mirror API logic is implemented.
   * auth.go: Handles authentication and log-out though OAuth 2.0
+  * account.go: Removes what the app created for a user when they sign out or
+                delete their account.
+  * onboarding.go: Sets up subscriptions, contacts and a welcome card for new
+                   users from a Task Queue.
   * notify.go: Handles push notifications from the Mirror API.
+  * quota.go: Counts Mirror API calls per user and operation, enforces daily
+              limits and shows consumption to admins on /admin/quota.
+  * audit.go: Records operations and notification side effects, listed and
+              exported for admins on /admin/audit.
+  * metrics.go: Exposes request, operation and Mirror API metrics on /metrics
+                in the Prometheus text format.
+  * upload.go: Validates media files uploaded with cards, also accepted from
+               API clients on /api/upload.
+  * resumable.go: Sends large media files to the Mirror API in chunks from a
+                  Task Queue, resuming interrupted uploads.
   * attachment.go: Proxies requests from the main page to retrieve media
                    attachments for the current user.
+  * thumbnail.go: Resizes image attachments into cached thumbnails served by
+                  the attachment proxy.
+  * share.go: Signs expiring links to attachments that users can share with
+              people who aren't signed in.
+  * contacts.go: Lists, creates, edits and deletes the user's contacts on
+                 /contacts.
+  * vcard.go: Imports contacts from vCard files and exports them as vCard 4.0.
+  * gallery.go: Lists the attachments of the whole timeline on /gallery and
+                downloads them as a zip archive.
+  * routing.go: Routes items shared with contacts to the pipeline each contact
+                is bound to: reply, archive, process pictures or webhook.
 */
 package quickstart
@@ -0,0 +1,128 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"code.google.com/p/goauth2/oauth"
+	"code.google.com/p/google-api-go-client/googleapi"
+)
+
+// appError is an error with the status code and message to show the user.
+// The underlying error is only logged since it may reveal internal details.
+type appError struct {
+	Code    int    // HTTP status code.
+	Message string // Shown to the user.
+	Err     error  // Cause of the error, if any.
+}
+
+func (e *appError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Message, e.Err)
+}
+
+var errorTmpl = template.Must(template.ParseFiles("error.html"))
+
+// badRequest returns an error for invalid input from the user.
+func badRequest(format string, args ...interface{}) error {
+	return &appError{http.StatusBadRequest, fmt.Sprintf(format, args...), nil}
+}
+
+// wrapError returns an *appError explaining that msg failed, giving the reason
+// and status code matching the cause. *appErrors are returned unchanged.
+func wrapError(err error, msg string) error {
+	if _, ok := err.(*appError); ok {
+		return err
+	}
+	code, reason := errorStatus(err)
+	if reason != "" {
+		msg += ": " + reason
+	}
+	return &appError{code, msg + ".", err}
+}
+
+// errorStatus returns the status code to serve for err and, if the user can do
+// something about it, the reason to give them.
+func errorStatus(err error) (int, string) {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	switch e := err.(type) {
+	case *googleapi.Error:
+		switch {
+		case e.Code == http.StatusUnauthorized:
+			return http.StatusUnauthorized, "your authorization has expired, please sign in again"
+		case rateLimited(e):
+			return 429, "Glass is receiving too many requests, please try again later"
+		case e.Code == http.StatusForbidden:
+			return http.StatusForbidden, "the app isn't allowed to do this"
+		case e.Code == http.StatusNotFound:
+			return http.StatusNotFound, "it doesn't exist anymore"
+		case e.Code == 429:
+			return 429, "Glass is receiving too many requests, please try again later"
+		case e.Code >= http.StatusInternalServerError:
+			return http.StatusBadGateway, "the Mirror API is unavailable, please try again later"
+		}
+	case oauth.OAuthError, *oauth.OAuthError:
+		return http.StatusUnauthorized, "your authorization has expired, please sign in again"
+	case *quotaError:
+		return 429, "the daily quota of the app has been reached, please try again tomorrow"
+	}
+	return http.StatusInternalServerError, ""
+}
+
+// userMessage returns the message to show the user for err.
+func userMessage(err error) string {
+	if e, ok := err.(*appError); ok {
+		return e.Message
+	}
+	return "Something went wrong."
+}
+
+// writeError serves the error page for err, as JSON for API requests and
+// clients that prefer it. The correlation ID is given as the error ID so that
+// it can be looked up in the logs.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code, _ := errorStatus(err)
+	if e, ok := err.(*appError); ok {
+		code = e.Code
+	}
+	data := struct {
+		Code    int    `json:"code"`
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		ID      string `json:"id"`
+	}{code, http.StatusText(code), userMessage(err), correlationID(r)}
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	if strings.HasPrefix(r.URL.Path, "/api/") || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": data})
+		return
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	errorTmpl.Execute(w, data)
+}
@@ -0,0 +1,157 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"appengine"
+	"appengine/memcache"
+	"appengine/socket"
+	"appengine/urlfetch"
+)
+
+// Address ranges media is never fetched from: loopback, private, link-local
+// (including the metadata server), shared and multicast addresses.
+var blockedNetworks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16",
+		"198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		blockedNetworks = append(blockedNetworks, n)
+	}
+}
+
+var errTooManyRedirects = errors.New("Too many redirects")
+
+// fetchMedia downloads a media file given by the user. URLs starting with "/"
+// are resolved against the app's own host and trusted; others must point to a
+// public address, even after redirects. The file is checked like an upload
+// and small files are cached by URL.
+func fetchMedia(c appengine.Context, host, rawurl string) (*upload, error) {
+	trusted := strings.HasPrefix(rawurl, "/") && !strings.HasPrefix(rawurl, "//")
+	if trusted {
+		rawurl = fullURL(host, rawurl)
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, badRequest("%s is not a valid media URL.", rawurl)
+	}
+
+	// The host is checked even for cached media, since what it resolves to
+	// or the blocked networks may have changed.
+	if !trusted {
+		if err = checkPublicHost(c, u); err != nil {
+			return nil, err
+		}
+	}
+	sum := sha256.Sum256([]byte(u.String()))
+	cacheKey := "media:" + hex.EncodeToString(sum[:])
+	m := new(upload)
+	if _, err := memcache.Gob.Get(c, cacheKey, m); err == nil {
+		return m, nil
+	}
+
+	client := &http.Client{
+		Transport: &urlfetch.Transport{Context: c, Deadline: mediaFetchTimeout},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= mediaFetchMaxRedirects {
+				return errTooManyRedirects
+			}
+			if trusted && req.URL.Host == u.Host {
+				return nil
+			}
+			return checkPublicHost(c, req.URL)
+		},
+	}
+	c.Infof("Downloading media from: %s", u)
+	resp, err := client.Get(u.String())
+	if err != nil {
+		if ue, ok := err.(*url.Error); ok {
+			if _, ok := ue.Err.(*appError); ok {
+				return nil, ue.Err // A redirect was blocked.
+			}
+		}
+		return nil, wrapError(err, "Unable to retrieve media from "+u.Host)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &appError{http.StatusBadGateway, fmt.Sprintf("Unable to retrieve media from %s: %s.", u.Host, resp.Status), nil}
+	}
+	if resp.ContentLength > uploadMaxBytes {
+		return nil, badRequest("The media at %s is larger than %d MB.", u, uploadMaxBytes>>20)
+	}
+	if m, err = readUpload("The media at "+u.String(), resp.Header.Get("Content-Type"), resp.Body); err != nil {
+		return nil, err
+	}
+	m.Name = u.String()
+
+	if len(m.Data) <= mediaCacheMaxBytes {
+		item := &memcache.Item{Key: cacheKey, Object: m, Expiration: mediaCacheExpiration}
+		if err := memcache.Gob.Set(c, item); err != nil {
+			c.Errorf("Unable to cache media: %v", err)
+		}
+	}
+	return m, nil
+}
+
+// checkPublicHost returns an error unless all the addresses of the URL's host
+// are public. The host is resolved again by urlfetch, so this doesn't protect
+// against DNS rebinding.
+func checkPublicHost(c appengine.Context, u *url.URL) error {
+	blocked := badRequest("Media can't be fetched from %s.", u.Host)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return blocked
+	}
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".internal") {
+		return blocked
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = socket.LookupIP(c, host); err != nil || len(ips) == 0 {
+			return badRequest("Unable to resolve %s.", u.Host)
+		}
+	}
+	for _, ip := range ips {
+		for _, n := range blockedNetworks {
+			if n.Contains(ip) {
+				c.Warningf("Blocked media fetch from %s (%s)", u.Host, ip)
+				return blocked
+			}
+		}
+	}
+	return nil
+}
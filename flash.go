@@ -0,0 +1,179 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+// Severities of flash messages, named after the Bootstrap alert classes.
+const (
+	flashSuccess = "success"
+	flashInfo    = "info"
+	flashWarning = "warning"
+	flashError   = "error"
+)
+
+// Flash is a message queued for a user, such as the outcome of an operation.
+// Flashes are stored under a FlashQueue key per user so that the queue is
+// strongly consistent, and cached in memcache.
+type Flash struct {
+	ID       int64 `datastore:"-"`
+	Severity string
+	Message  string `datastore:",noindex"`
+	Created  time.Time
+}
+
+// Sticky reports whether the message stays until the user dismisses it.
+// Others are only shown once.
+func (f *Flash) Sticky() bool {
+	return f.Severity == flashWarning || f.Severity == flashError
+}
+
+// flashQueueKey returns the parent key of the user's messages.
+func flashQueueKey(c appengine.Context, userId string) *datastore.Key {
+	return datastore.NewKey(c, "FlashQueue", userId, 0, nil)
+}
+
+func flashCacheKey(userId string) string {
+	return "flash:" + userId
+}
+
+// pushFlash queues a message for the user.
+func pushFlash(c appengine.Context, userId, severity, msg string) {
+	f := &Flash{Severity: severity, Message: msg, Created: time.Now()}
+	key := datastore.NewIncompleteKey(c, "Flash", flashQueueKey(c, userId))
+	if _, err := datastore.Put(c, key, f); err != nil {
+		c.Errorf("Unable to store message: %v", err)
+		return
+	}
+	memcache.Delete(c, flashCacheKey(userId))
+}
+
+// userFlashes returns the messages to show the user, oldest first. Messages
+// that are only shown once are removed from the queue, as well as those over
+// flashMaxMessages or older than flashMaxAge.
+func userFlashes(c appengine.Context, userId string) []*Flash {
+	var queued []*Flash
+	if _, err := memcache.Gob.Get(c, flashCacheKey(userId), &queued); err != nil {
+		q := datastore.NewQuery("Flash").Ancestor(flashQueueKey(c, userId)).Order("Created")
+		keys, err := q.GetAll(c, &queued)
+		if err != nil {
+			c.Errorf("Unable to retrieve messages: %v", err)
+			return nil
+		}
+		for i, k := range keys {
+			queued[i].ID = k.IntID()
+		}
+	}
+
+	now := time.Now()
+	var shown, kept []*Flash
+	var removed []*datastore.Key
+	for i, f := range queued {
+		if len(queued)-i > flashMaxMessages || now.Sub(f.Created) > flashMaxAge {
+			removed = append(removed, flashKey(c, userId, f.ID))
+			continue
+		}
+		shown = append(shown, f)
+		if f.Sticky() {
+			kept = append(kept, f)
+		} else {
+			removed = append(removed, flashKey(c, userId, f.ID))
+		}
+	}
+	if err := datastore.DeleteMulti(c, removed); err != nil {
+		c.Errorf("Unable to remove messages: %v", err)
+		memcache.Delete(c, flashCacheKey(userId))
+		return shown
+	}
+	item := &memcache.Item{Key: flashCacheKey(userId), Object: kept}
+	if err := memcache.Gob.Set(c, item); err != nil {
+		c.Errorf("Unable to cache messages: %v", err)
+	}
+	return shown
+}
+
+// flashKey returns the key of one of the user's messages.
+func flashKey(c appengine.Context, userId string, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Flash", "", id, flashQueueKey(c, userId))
+}
+
+// deleteFlashes removes all the user's messages.
+func deleteFlashes(c appengine.Context, userId string) error {
+	keys, err := datastore.NewQuery("Flash").Ancestor(flashQueueKey(c, userId)).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	if err = datastore.DeleteMulti(c, keys); err != nil {
+		return err
+	}
+	memcache.Delete(c, flashCacheKey(userId))
+	return nil
+}
+
+// Because App Engine owns main and starts the HTTP service,
+// we do our setup during initialization.
+func init() {
+	http.HandleFunc("/flash/dismiss", instrumented("flash.dismiss", errorAdapter(authenticated(dismissFlashHandler))))
+}
+
+// dismissFlashHandler removes one of the current user's messages and sends
+// them back to the page given by the "next" form value. Dismissals don't touch
+// Glass, so they aren't run as operations.
+func dismissFlashHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return &appError{http.StatusMethodNotAllowed, "Messages must be dismissed with a POST.", nil}
+	}
+	c := newContext(r)
+	userId := currentUser(r)
+	id, err := strconv.ParseInt(r.FormValue("flashId"), 10, 64)
+	if err != nil {
+		return badRequest("Invalid message ID.")
+	}
+	if err = datastore.Delete(c, flashKey(c, userId, id)); err != nil && err != datastore.ErrNoSuchEntity {
+		return wrapError(err, "Unable to dismiss the message")
+	}
+	memcache.Delete(c, flashCacheKey(userId))
+	next := r.FormValue("next")
+	if !localPath(next) {
+		next = "/"
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+	return nil
+}
+
+// localPath reports whether s is a path on this site that is safe to redirect
+// to. Browsers read backslashes as slashes, so "/\host" would leave it.
+func localPath(s string) bool {
+	if strings.Contains(s, `\`) || strings.HasPrefix(s, "//") {
+		return false
+	}
+	for _, r := range s {
+		if r < ' ' || r == 0x7f {
+			return false
+		}
+	}
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "" && u.Host == "" && u.User == nil && strings.HasPrefix(u.Path, "/")
+}
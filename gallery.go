@@ -0,0 +1,212 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"archive/zip"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.google.com/p/google-api-go-client/mirror/v1"
+
+	"appengine"
+)
+
+var galleryTmpl = template.Must(template.New("gallery.html").
+	Funcs(template.FuncMap{"HasPrefix": strings.HasPrefix}).
+	ParseFiles("gallery.html"))
+
+// Because App Engine owns main and starts the HTTP service,
+// we do our setup during initialization.
+func init() {
+	http.HandleFunc("/gallery", instrumented("gallery", errorAdapter(authenticated(galleryHandler))))
+	http.HandleFunc("/gallery/download", instrumented("gallery.download", errorAdapter(authenticated(galleryDownloadHandler))))
+}
+
+// galleryAttachment is an attachment listed in the gallery.
+type galleryAttachment struct {
+	ItemId      string
+	Id          string
+	ContentType string
+	Time        time.Time
+}
+
+// galleryGroup holds the attachments of a day with the same kind of content.
+type galleryGroup struct {
+	Day         string
+	Kind        string // Top-level media type, such as "image".
+	Attachments []*galleryAttachment
+}
+
+// itemTime returns when an item is shown on the timeline.
+func itemTime(item *mirror.TimelineItem) time.Time {
+	for _, s := range []string{item.DisplayTime, item.Created} {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// galleryGroups pages through the user's timeline, at most galleryMaxItems
+// items, and groups their attachments by day and kind of content, most recent
+// first. It also returns whether the timeline had more items.
+func galleryGroups(c appengine.Context, svc *mirror.Service) ([]*galleryGroup, bool, error) {
+	var groups []*galleryGroup
+	byKey := make(map[string]*galleryGroup)
+	pageToken := ""
+	for n := 0; n < galleryMaxItems; {
+		var l *mirror.TimelineListResponse
+		err := mirrorCall(c, "timeline.list", func() (err error) {
+			l, err = svc.Timeline.List().PageToken(pageToken).Do()
+			return
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		for _, item := range l.Items {
+			t := itemTime(item)
+			day := t.UTC().Format("Monday, January 2, 2006")
+			for _, a := range item.Attachments {
+				kind := strings.SplitN(a.ContentType, "/", 2)[0]
+				g := byKey[day+"\x00"+kind]
+				if g == nil {
+					g = &galleryGroup{Day: day, Kind: kind}
+					byKey[day+"\x00"+kind] = g
+					groups = append(groups, g)
+				}
+				g.Attachments = append(g.Attachments, &galleryAttachment{item.Id, a.Id, a.ContentType, t})
+			}
+		}
+		n += len(l.Items)
+		if pageToken = l.NextPageToken; pageToken == "" {
+			return groups, false, nil
+		}
+	}
+	return groups, true, nil
+}
+
+// gallery lists the attachments of the user's whole timeline.
+func galleryHandler(w http.ResponseWriter, r *http.Request) error {
+	c := newContext(r)
+	groups, truncated, err := galleryGroups(c, currentService(r))
+	if err != nil {
+		return wrapError(err, "Unable to list your timeline")
+	}
+	return galleryTmpl.Execute(w, struct {
+		Groups       []*galleryGroup
+		Truncated    bool
+		MaxItems     int
+		MaxDownloads int
+	}{groups, truncated, galleryMaxItems, galleryDownloadMaxFiles})
+}
+
+// galleryDownload streams a zip archive of the attachments given by the
+// "attachment" form values, each an item ID and attachment ID separated by a
+// slash. Attachments that can't be added are listed in an errors.txt file of
+// the archive since the response has started by then.
+func galleryDownloadHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return &appError{http.StatusMethodNotAllowed, "Downloads must be POSTed.", nil}
+	}
+	c := newContext(r)
+	userId := currentUser(r)
+	r.ParseForm()
+	ids := r.Form["attachment"]
+	if len(ids) == 0 {
+		return badRequest("No attachment was selected.")
+	}
+	if len(ids) > galleryDownloadMaxFiles {
+		return badRequest("At most %d attachments can be downloaded at once.", galleryDownloadMaxFiles)
+	}
+	for _, id := range ids {
+		if !strings.Contains(id, "/") {
+			return badRequest("Invalid attachment %q.", id)
+		}
+	}
+
+	start := time.Now()
+	h := w.Header()
+	h.Set("Content-Type", "application/zip")
+	h.Set("Content-Disposition", `attachment; filename="glass-attachments.zip"`)
+	h.Set("Cache-Control", "no-store")
+	z := zip.NewWriter(w)
+	var failures []string
+	var resources []string
+	remaining := int64(galleryDownloadMaxBytes)
+	for _, id := range ids {
+		parts := strings.SplitN(id, "/", 2)
+		itemId, attachmentId := parts[0], parts[1]
+		if remaining <= 0 {
+			failures = append(failures, id+": the archive is full")
+			continue
+		}
+		n, err := zipAttachment(c, r, z, userId, itemId, attachmentId, remaining)
+		remaining -= n
+		if err != nil {
+			c.Errorf("Unable to add attachment %s to the archive: %s", id, err)
+			failures = append(failures, id+": "+userMessage(err))
+			continue
+		}
+		resources = append(resources, itemId)
+	}
+	if failures != nil {
+		if f, err := z.Create("errors.txt"); err == nil {
+			fmt.Fprintf(f, "These attachments couldn't be downloaded:\r\n%s\r\n", strings.Join(failures, "\r\n"))
+		}
+	}
+	err := z.Close()
+	if err == nil && failures != nil {
+		err = fmt.Errorf("Unable to add %s", strings.Join(failures, "; "))
+	}
+	e := &AuditEntry{Actor: userId, UserId: userId, Operation: "gallery.download", Resources: resources}
+	audit(c, e, err, time.Since(start))
+	return nil
+}
+
+// zipAttachment adds an attachment to the archive if it is at most max bytes,
+// so that no entry is ever cut short. Media is already compressed so it is
+// stored as is. It returns the number of bytes added.
+func zipAttachment(c appengine.Context, r *http.Request, z *zip.Writer, userId, itemId, attachmentId string, max int64) (int64, error) {
+	hash := attachmentHash(userId, itemId, attachmentId)
+	body, ct, err := openAttachment(c, r, hash, itemId, attachmentId)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return 0, wrapError(err, "Unable to download the attachment")
+	}
+	if int64(len(data)) > max {
+		return 0, &appError{http.StatusRequestEntityTooLarge, "it doesn't fit in the archive", nil}
+	}
+	name := itemId + "-" + attachmentId
+	if exts, _ := mime.ExtensionsByType(ct); len(exts) > 0 {
+		name += exts[0]
+	}
+	f, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.Write(data)
+	return int64(n), err
+}
@@ -17,27 +17,29 @@ package quickstart
 import (
 	"fmt"
 	"html/template"
-	"io"
 	"net/http"
 	"strings"
 	"time"
 
 	"code.google.com/p/goauth2/oauth"
-	"code.google.com/p/google-api-go-client/googleapi"
 	"code.google.com/p/google-api-go-client/mirror/v1"
 
 	"appengine"
 	"appengine/datastore"
-	"appengine/memcache"
-	"appengine/urlfetch"
 )
 
 type uiTemplateData struct {
-	Message                    string
+	Flashes                    []*Flash
+	Warnings                   []string // Parts of the page that couldn't be loaded.
 	TimelineItems              []*mirror.TimelineItem
 	Contact                    *mirror.Contact
 	TimelineSubscriptionExists bool
 	LocationSubscriptionExists bool
+	Granted                    map[string]bool
+	Sessions                   []*Session
+	CurrentSession             string
+	Onboarding                 *Onboarding
+	Uploads                    []*ResumableUpload
 }
 
 // Main template.
@@ -46,8 +48,25 @@ var rootTmpl = template.Must(template.New("index.html").
 	Funcs(template.FuncMap{"HasPrefix": strings.HasPrefix}).
 	ParseFiles("index.html"))
 
+// operation runs an action of the main page. It returns what it did on
+// success, and an *appError otherwise.
+type operation func(*http.Request, *mirror.Service) (*operationResult, error)
+
+// operationResult is the outcome of an operation that succeeded, shown to the
+// user on the next page view.
+type operationResult struct {
+	Message  string // Nothing is shown if empty.
+	Severity string // Of the message, flashSuccess if empty.
+}
+
+// done returns the result of an operation that succeeded, with a message
+// formatted as by fmt.Sprintf.
+func done(format string, args ...interface{}) *operationResult {
+	return &operationResult{Message: fmt.Sprintf(format, args...)}
+}
+
 // Map of operations to functions.
-var operations = map[string]func(*http.Request, *mirror.Service) string{
+var operations = map[string]operation{
 	"insertSubscription":     insertSubscription,
 	"deleteSubscription":     deleteSubscription,
 	"insertItem":             insertItem,
@@ -55,92 +74,83 @@ var operations = map[string]func(*http.Request, *mirror.Service) string{
 	"insertItemAllUsers":     insertItemAllUsers,
 	"insertContact":          insertContact,
 	"deleteContact":          deleteContact,
+	"saveContact":            saveContact,
+	"importContacts":         importContacts,
+	"routeContact":           routeContact,
 	"deleteTimelineItem":     deleteTimelineItem,
 	"deleteAllTimelineItems": deleteAllTimelineItems,
+	"revokeSession":          revokeSession,
+	"retryOnboarding":        retryOnboarding,
+	"shareAttachment":        shareAttachment,
+	"retryUpload":            retryUpload,
+	"cancelUpload":           cancelUpload,
 }
 
 // Because App Engine owns main and starts the HTTP service,
 // we do our setup during initialization.
 func init() {
-	http.HandleFunc("/", errorAdapter(rootHandler))
+	http.HandleFunc("/", instrumented("root", errorAdapter(rootOnly(authenticated(rootHandler)))))
 }
 
-// root is the main handler.
-func rootHandler(w http.ResponseWriter, r *http.Request) error {
-	if r.URL.Path != "/" { // Only supports request on "/", ignore the rest.
-		http.Error(w, "", http.StatusNotFound)
-		return nil
+// rootOnly serves a 404 for the paths other than "/" that the "/" pattern
+// matches, before looking up the user.
+func rootOnly(f func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if r.URL.Path != "/" {
+			http.Error(w, "", http.StatusNotFound)
+			return nil
+		}
+		return f(w, r)
 	}
-	c := appengine.NewContext(r)
+}
 
-	userId, err := userID(r)
-	if err != nil {
-		return fmt.Errorf("Unable to retrieve user ID: %s", err)
-	}
-	if userId == "" {
-		http.Redirect(w, r, "/auth", http.StatusFound)
-		return nil
-	}
-	t := authTransport(c, userId)
-	if t == nil {
-		http.Redirect(w, r, "/auth", http.StatusFound)
-		return nil
-	}
-	if err = t.Refresh(); err != nil { // Check for valid credentials.
-		http.Redirect(w, r, "/auth", http.StatusFound)
-		return nil
-	}
-	svc, err := mirror.New(t.Client())
-	if err != nil {
-		return fmt.Errorf("Unable to create Mirror service: %s", err)
-	}
+// root is the main handler.
+func rootHandler(w http.ResponseWriter, r *http.Request) error {
+	c := newContext(r)
+	userId, svc := currentUser(r), currentService(r)
 
 	if r.Method == "POST" {
-		op := r.FormValue("operation")
-		msg := fmt.Sprintf("I don't know how to %s", op)
-		if o, ok := operations[op]; ok {
-			msg = o(r, svc)
-		}
-		m := &memcache.Item{
-			Key:        userId,
-			Value:      []byte(msg),
-			Expiration: 5 * time.Second,
-		}
-		if err := memcache.Set(c, m); err != nil {
-			c.Errorf("Unable to store message: %v", err)
+		// Ask for the missing scope first; the operation is kept in the
+		// session and resumed once the user has granted it.
+		r.ParseForm()
+		if s := requiredScope(r.Form); s != "" && !grantedScopes(c, userId)[s] {
+			session, err := store.Get(r, sessionName)
+			if err != nil {
+				return wrapError(err, "Unable to retrieve your session")
+			}
+			session.Values[pendingOperationKey] = r.Form.Encode()
+			if err = session.Save(r, w); err != nil {
+				return wrapError(err, "Unable to store your session")
+			}
+			http.Redirect(w, r, "/auth?scope="+s, http.StatusFound)
+			return nil
 		}
+		runOperation(c, r, svc, userId, r.FormValue("operation"))
 
 		http.Redirect(w, r, "/", http.StatusFound)
 		return nil
 	}
 
-	timelineItems, err := svc.Timeline.List().MaxResults(3).Do()
-	if err != nil {
-		return err
+	d, warnings := loadDashboard(c, currentTransport(r), userId)
+	tData := uiTemplateData{
+		Flashes:       userFlashes(c, userId),
+		Warnings:      warnings,
+		TimelineItems: d.TimelineItems,
+		Contact:       d.Contact,
+		Granted:       grantedScopes(c, userId),
 	}
-	contact, err := svc.Contacts.Get("Go_Quick_Start").Do()
-	if err != nil { // 404 should not be considered an error.
-		if error, ok := err.(*googleapi.Error); !ok || error.Code != http.StatusNotFound {
-			return err
-		}
+	var err error
+	if tData.Sessions, err = userSessions(c, userId); err != nil {
+		c.Errorf("Unable to list sessions: %v", err)
 	}
-	subscriptions, err := svc.Subscriptions.List().Do()
-	if err != nil {
-		return err
+	tData.CurrentSession = sessionID(r)
+	if tData.Onboarding, err = onboardingStatus(c, userId); err != nil {
+		c.Errorf("Unable to retrieve onboarding: %v", err)
 	}
-
-	message := ""
-	if m, err := memcache.Get(c, userId); err == nil {
-		message = string(m.Value)
-		memcache.Delete(c, userId)
+	if tData.Uploads, err = userUploads(c, userId); err != nil {
+		c.Errorf("Unable to list uploads: %v", err)
 	}
-
-	tData := uiTemplateData{
-		Message:       message,
-		TimelineItems: timelineItems.Items,
-		Contact:       contact,
-	}
-	for _, s := range subscriptions.Items {
+	for _, s := range d.Subscriptions {
 		if s.Collection == "timeline" {
 			tData.TimelineSubscriptionExists = true
 		} else if s.Collection == "locations" {
@@ -151,42 +161,82 @@ func rootHandler(w http.ResponseWriter, r *http.Request) error {
 	return rootTmpl.Execute(w, tData)
 }
 
+// runOperation runs the operation of the current user named op, records it and
+// queues its outcome to be displayed on the next page view.
+func runOperation(c appengine.Context, r *http.Request, svc *mirror.Service, userId, op string) {
+	o, ok := operations[op]
+	if !ok {
+		pushFlash(c, userId, flashError, fmt.Sprintf("I don't know how to %s", op))
+		return
+	}
+	start := time.Now()
+	res, err := o(r, svc)
+	latency := time.Since(start)
+	severity, msg, result := flashSuccess, "", "ok"
+	if err != nil {
+		c.Errorf("Operation %s failed: %s", op, err)
+		auditFailure(r, err)
+		severity, msg, result = flashError, userMessage(err), "error"
+	} else if res != nil {
+		msg = res.Message
+		if res.Severity != "" {
+			severity = res.Severity
+		}
+	}
+	auditOperation(c, r, userId, op, latency)
+	invalidateDashboard(c, userId)
+	operationsRun.inc(c, op, result)
+	operationDuration.observe(c, latency, op)
+	if msg != "" {
+		pushFlash(c, userId, severity, msg)
+	}
+}
+
 // insertSubscription subscribes the app to notifications for the current user.
-func insertSubscription(r *http.Request, svc *mirror.Service) string {
+func insertSubscription(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
 	collection := r.FormValue("collection")
 	if collection == "" {
 		collection = "timeline"
 	}
-	userToken, err := userID(r)
-	if err != nil {
-		return fmt.Sprintf("Unable to retrieve user ID: %s", err)
-	}
 	body := mirror.Subscription{
 		Collection:  collection,
-		UserToken:   userToken,
+		UserToken:   currentUser(r),
 		CallbackUrl: fullURL(r.Host, "/notify"),
 	}
 
-	if _, err = svc.Subscriptions.Insert(&body).Do(); err != nil {
-		return fmt.Sprintf("Unable to subscribe: %s", err)
+	var s *mirror.Subscription
+	err := mirrorCall(c, "subscriptions.insert", func() (err error) {
+		s, err = svc.Subscriptions.Insert(&body).Do()
+		return
+	})
+	if err != nil {
+		return nil, wrapError(err, "Unable to subscribe")
 	}
-	return "Application is now subscribed to updates."
+	auditResource(r, s.Id)
+	return done("Application is now subscribed to updates."), nil
 }
 
 // deleteSubscription unsubscribes the app from notifications for the current
 // user.
-func deleteSubscription(r *http.Request, svc *mirror.Service) string {
+func deleteSubscription(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
 	collection := r.FormValue("subscriptionId")
+	auditResource(r, collection)
 
-	if err := svc.Subscriptions.Delete(collection).Do(); err != nil {
-		return fmt.Sprintf("Unable to unsubscribe: %s", err)
+	err := mirrorCall(c, "subscriptions.delete", func() error {
+		return svc.Subscriptions.Delete(collection).Do()
+	})
+	if err != nil {
+		return nil, wrapError(err, "Unable to unsubscribe")
 	}
-	return "Application has been unsubscribed."
+	return done("Application has been unsubscribed."), nil
 }
 
-// insertItem inserts a Timeline Item in the user's Timeline.
-func insertItem(r *http.Request, svc *mirror.Service) string {
-	c := appengine.NewContext(r)
+// insertItem inserts a Timeline Item in the user's Timeline, with the files
+// uploaded in the "media" field or the image at "imageUrl" if any.
+func insertItem(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
 	c.Infof("Inserting Timeline Item")
 
 	body := mirror.TimelineItem{
@@ -198,31 +248,34 @@ func insertItem(r *http.Request, svc *mirror.Service) string {
 		body.Text = r.FormValue("message")
 	}
 
-	var media io.Reader = nil
-	mediaLink := r.FormValue("imageUrl")
-	if mediaLink != "" {
-		if strings.HasPrefix(mediaLink, "/") {
-			mediaLink = fullURL(r.Host, mediaLink)
-		}
-		c.Infof("Downloading media from: %s", mediaLink)
-		client := urlfetch.Client(c)
-		if resp, err := client.Get(mediaLink); err != nil {
-			c.Errorf("Unable to retrieve media: %s", err)
-		} else {
-			defer resp.Body.Close()
-			media = resp.Body
+	media, err := formUploads(r)
+	if err != nil {
+		return nil, err
+	}
+	if mediaLink := r.FormValue("imageUrl"); len(media) == 0 && mediaLink != "" {
+		m, err := fetchMedia(c, r.Host, mediaLink)
+		if err != nil {
+			return nil, err
 		}
+		media = []*upload{m}
 	}
 
-	if _, err := svc.Timeline.Insert(&body).Media(media).Do(); err != nil {
-		return fmt.Sprintf("Unable to insert timeline item: %s", err)
+	item, err := insertMediaItem(c, svc, &body, media)
+	if item != nil {
+		auditResource(r, item.Id)
+	}
+	if err != nil {
+		return nil, wrapError(err, "Unable to insert timeline item")
+	}
+	if len(media) > 1 {
+		return done("A timeline item with %d attachments has been inserted.", len(media)), nil
 	}
-	return "A timeline item has been inserted."
+	return done("A timeline item has been inserted."), nil
 }
 
 // insertItemWithAction inserts a Timeline Item that the user can reply to.
-func insertItemWithAction(r *http.Request, svc *mirror.Service) string {
-	c := appengine.NewContext(r)
+func insertItemWithAction(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
 	c.Infof("Inserting Timeline Item")
 
 	body := mirror.TimelineItem{
@@ -232,59 +285,98 @@ func insertItemWithAction(r *http.Request, svc *mirror.Service) string {
 		MenuItems:    []*mirror.MenuItem{&mirror.MenuItem{Action: "REPLY"}},
 	}
 
-	if _, err := svc.Timeline.Insert(&body).Do(); err != nil {
-		return fmt.Sprintf("Unable to insert timeline item: %s", err)
+	var item *mirror.TimelineItem
+	err := mirrorCall(c, "timeline.insert", func() (err error) {
+		item, err = svc.Timeline.Insert(&body).Do()
+		return
+	})
+	if err != nil {
+		return nil, wrapError(err, "Unable to insert timeline item")
 	}
-	return "A timeline item with action has been inserted."
+	auditResource(r, item.Id)
+	return done("A timeline item with action has been inserted."), nil
 }
 
-// insertItemAllUsers inserts a Timeline Item to all authorized users.
-func insertItemAllUsers(r *http.Request, svc *mirror.Service) string {
-	c := appengine.NewContext(r)
+// insertItemAllUsers inserts a Timeline Item to all authorized users. It
+// fails if the card couldn't be sent to some of them.
+func insertItemAllUsers(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
 	c.Infof("Inserting timeline item to all users")
 
 	q := datastore.NewQuery("OAuth2Token")
 	count, err := q.Count(c)
 	if err != nil {
-		return fmt.Sprintf("Unable to fetch users: %s", err)
+		return nil, wrapError(err, "Unable to fetch users")
 	}
-	if count > 5 {
-		return fmt.Sprintf("Total user count is %d. Aborting broadcast to save your quota", count)
+	if remaining := quotaRemaining(c); int64(count) > remaining {
+		return nil, &appError{429, fmt.Sprintf("Total user count is %d but only %d calls are left in today's quota. Aborting broadcast.", count, remaining), nil}
 	}
 	body := mirror.TimelineItem{
 		Text:         "Hello Everyone!",
 		Notification: &mirror.NotificationConfig{Level: "AUDIO_ONLY"},
 	}
-	i := q.Run(c)
-	tok := new(oauth.Token)
-	creds := &oauth.Transport{
-		Config:    config(""),
-		Token:     tok,
-		Transport: &urlfetch.Transport{Context: c},
+	var tokens []*oauth.Token
+	keys, err := q.GetAll(c, &tokens)
+	if err != nil {
+		return nil, wrapError(err, "Unable to fetch users")
 	}
-	svc, _ = mirror.New(creds.Client())
 	failed := 0
 
-	for _, err = i.Next(tok); err == nil; _, err = i.Next(tok) {
-		if _, err := svc.Timeline.Insert(&body).Do(); err != nil {
+	// Each part of the batch is authorized as a different user.
+	calls := make([]*batchCall, 0, len(tokens))
+	for i, tok := range tokens {
+		if tok.Expired() {
+			creds := &oauth.Transport{
+				Config:    config(""),
+				Token:     tok,
+				Transport: newTransport(c, keys[i].StringID()),
+			}
+			if err := creds.Refresh(); err != nil {
+				refreshFailures.inc(c)
+				c.Errorf("Unable to refresh credentials of %s: %s", keys[i].StringID(), err)
+				failed += 1
+				continue
+			}
+			storeCredential(c, keys[i].StringID(), tok)
+		}
+		calls = append(calls, &batchCall{
+			UserId: keys[i].StringID(),
+			Method: "POST",
+			Path:   "timeline",
+			Body:   &body,
+			Header: http.Header{"Authorization": {"Bearer " + tok.AccessToken}},
+		})
+	}
+	client := &http.Client{Transport: newTransport(c, "")}
+	for i, res := range mirrorBatch(c, client, calls) {
+		var item mirror.TimelineItem
+		if err := res.decode(&item); err != nil {
 			c.Errorf("Failed to insert timeline item: %s", err)
 			failed += 1
+			continue
 		}
+		auditResource(r, item.Id)
+		invalidateDashboard(c, calls[i].UserId)
+	}
+	msg := fmt.Sprintf("Sent cards to %d (%d failed).", count, failed)
+	if failed > 0 {
+		return nil, &appError{http.StatusBadGateway, msg, nil}
 	}
-	return fmt.Sprintf("Sent cards to %d (%d failed).", count, failed)
+	return &operationResult{Message: msg}, nil
 }
 
 // insertContact inserts a contact.
-func insertContact(r *http.Request, svc *mirror.Service) string {
-	c := appengine.NewContext(r)
+func insertContact(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
 	c.Infof("Inserting contact")
 	name := r.FormValue("name")
 	imageUrl := r.FormValue("imageUrl")
 	if name == "" || imageUrl == "" {
-		return "Must specify imageUrl and name to insert contact"
+		return nil, badRequest("Must specify imageUrl and name to insert contact")
 	}
-	if strings.HasPrefix(imageUrl, "/") {
-		imageUrl = fullURL(r.Host, imageUrl)
+	imageUrl, err := checkContactImage(c, r.Host, imageUrl)
+	if err != nil {
+		return nil, err
 	}
 
 	body := mirror.Contact{
@@ -293,43 +385,62 @@ func insertContact(r *http.Request, svc *mirror.Service) string {
 		ImageUrls:   []string{imageUrl},
 	}
 
-	if _, err := svc.Contacts.Insert(&body).Do(); err != nil {
-		return fmt.Sprintf("Unable to insert contact: %s", err)
+	auditResource(r, body.Id)
+	err = mirrorCall(c, "contacts.insert", func() error {
+		_, err := svc.Contacts.Insert(&body).Do()
+		return err
+	})
+	if err != nil {
+		return nil, wrapError(err, "Unable to insert contact")
 	}
-	return fmt.Sprintf("Inserted contact: %s", name)
+	return done("Inserted contact: %s", name), nil
 }
 
 // deleteContact deletes an existing contact.
-func deleteContact(r *http.Request, svc *mirror.Service) string {
+func deleteContact(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
 	id := strings.Replace(r.FormValue("id"), " ", "_", -1)
+	auditResource(r, id)
 
-	if err := svc.Contacts.Delete(id).Do(); err != nil {
-		return fmt.Sprintf("Unable to delete contact: %s", err)
+	err := mirrorCall(c, "contacts.delete", func() error {
+		return svc.Contacts.Delete(id).Do()
+	})
+	if err != nil {
+		return nil, wrapError(err, "Unable to delete contact")
+	}
+	// The contact may be inserted again, without its pipeline or photo.
+	userId := currentUser(r)
+	key := datastore.NewKey(c, "ContactRoute", id, 0, contactRoutesKey(c, userId))
+	if err = datastore.Delete(c, key); err != nil && err != datastore.ErrNoSuchEntity {
+		c.Warningf("Unable to delete the route of contact %s: %s", id, err)
+	}
+	key = datastore.NewKey(c, "ContactPhoto", id, 0, contactPhotosKey(c, userId))
+	if err = datastore.Delete(c, key); err != nil && err != datastore.ErrNoSuchEntity {
+		c.Warningf("Unable to delete the photo of contact %s: %s", id, err)
 	}
-	return "Contact has been deleted."
+	return done("Contact has been deleted."), nil
 }
 
 // deleteTimelineItem deletes a timeline item.
-func deleteTimelineItem(r *http.Request, svc *mirror.Service) string {
+func deleteTimelineItem(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
 	itemId := r.FormValue("itemId")
-	err := svc.Timeline.Delete(itemId).Do()
+	auditResource(r, itemId)
+	err := mirrorCall(c, "timeline.delete", func() error {
+		return svc.Timeline.Delete(itemId).Do()
+	})
 	if err != nil {
-		return fmt.Sprintf("An error occurred: %v\n", err)
+		return nil, wrapError(err, "Unable to delete the timeline item")
 	}
-	return "A timeline item has been deleted."
+	return done("A timeline item has been deleted."), nil
 }
 
 // deleteAllTimelineItems deletes all timeline items.
-func deleteAllTimelineItems(r *http.Request, svc *mirror.Service) string {
-	timelineItems, err := svc.Timeline.List().Do()
-	if err != nil {
-		return fmt.Sprintf("An error occurred: %v\n", err)
-	}
-	for _, t := range timelineItems.Items {
-		err := svc.Timeline.Delete(t.Id).Do()
-		if err != nil {
-			return fmt.Sprintf("An error occurred: %v\n", err)
-		}
+func deleteAllTimelineItems(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
+	client := currentTransport(r).Client()
+	if err := deleteTimeline(c, svc, client, currentUser(r)); err != nil {
+		return nil, wrapError(err, "Unable to delete all timeline items")
 	}
-	return "All timeline items have been deleted."
+	return done("All timeline items have been deleted."), nil
 }
@@ -0,0 +1,367 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/context"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+// metric is a family of counters or histograms.
+type metric struct {
+	name   string
+	help   string
+	typ    string    // "counter" or "histogram".
+	labels []string  // Label names, values are given in the same order.
+	bucket []float64 // Upper bounds of histogram buckets, in seconds.
+}
+
+// Latency buckets shared by all histograms, in seconds.
+var latencyBuckets = []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Metrics exposed on /metrics.
+var (
+	httpRequests = &metric{
+		name:   "quickstart_http_requests_total",
+		help:   "HTTP requests handled, by handler and status code.",
+		typ:    "counter",
+		labels: []string{"handler", "code"},
+	}
+	httpDuration = &metric{
+		name:   "quickstart_http_request_duration_seconds",
+		help:   "Time spent handling HTTP requests, by handler.",
+		typ:    "histogram",
+		labels: []string{"handler"},
+		bucket: latencyBuckets,
+	}
+	operationsRun = &metric{
+		name:   "quickstart_operations_total",
+		help:   "Operations run from the main page, by operation and result.",
+		typ:    "counter",
+		labels: []string{"operation", "result"},
+	}
+	operationDuration = &metric{
+		name:   "quickstart_operation_duration_seconds",
+		help:   "Time spent running operations, by operation.",
+		typ:    "histogram",
+		labels: []string{"operation"},
+		bucket: latencyBuckets,
+	}
+	notificationDuration = &metric{
+		name:   "quickstart_notification_duration_seconds",
+		help:   "Time spent processing notifications, by collection.",
+		typ:    "histogram",
+		labels: []string{"collection"},
+		bucket: latencyBuckets,
+	}
+	mirrorCalls = &metric{
+		name:   "quickstart_mirror_calls_total",
+		help:   "Mirror API calls made, by operation and status code.",
+		typ:    "counter",
+		labels: []string{"operation", "code"},
+	}
+	mirrorDuration = &metric{
+		name:   "quickstart_mirror_call_duration_seconds",
+		help:   "Latency of Mirror API requests, by operation.",
+		typ:    "histogram",
+		labels: []string{"operation"},
+		bucket: latencyBuckets,
+	}
+	mirrorRetries = &metric{
+		name:   "quickstart_mirror_retries_total",
+		help:   "Mirror API calls retried after a transient failure, by operation.",
+		typ:    "counter",
+		labels: []string{"operation"},
+	}
+	cardsInserted = &metric{
+		name: "quickstart_cards_inserted_total",
+		help: "Timeline items inserted in users' timelines.",
+		typ:  "counter",
+	}
+	refreshFailures = &metric{
+		name: "quickstart_token_refresh_failures_total",
+		help: "Failures to refresh a user's access token.",
+		typ:  "counter",
+	}
+)
+
+// All metrics, in the order they are exposed.
+var metrics = []*metric{
+	httpRequests, httpDuration, operationsRun, operationDuration,
+	notificationDuration, mirrorCalls, mirrorDuration, mirrorRetries,
+	cardsInserted, refreshFailures,
+}
+
+// Histogram sums are stored in memcache as integer microseconds. Buckets are
+// stored as the number of observations that fell in each, and made cumulative
+// when exposed, so an observation costs two memcache calls.
+const sumScale = 1e6
+
+// MetricSeries indexes the series stored in memcache so that they can be
+// listed. Its key is the memcache key of the series.
+type MetricSeries struct {
+	Metric string
+}
+
+// Series already indexed by this instance.
+var (
+	seriesMu    sync.Mutex
+	seriesKnown = make(map[string]bool)
+)
+
+// Because App Engine owns main and starts the HTTP service,
+// we do our setup during initialization.
+func init() {
+	http.HandleFunc("/metrics", metricsHandler)
+}
+
+// series returns the name of a series of the metric, in exposition format.
+func (m *metric) series(suffix string, values []string, extra ...string) string {
+	var pairs []string
+	for i, l := range m.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l, values[i]))
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return m.name + suffix
+	}
+	return m.name + suffix + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// inc increments a counter.
+func (m *metric) inc(c appengine.Context, values ...string) {
+	m.add(c, m.series("", values), 1)
+}
+
+// observe records a duration in a histogram.
+func (m *metric) observe(c appengine.Context, d time.Duration, values ...string) {
+	le := "+Inf"
+	for _, b := range m.bucket {
+		if d.Seconds() <= b {
+			le = bucketLabel(b)
+			break
+		}
+	}
+	m.add(c, m.series("_bucket", values, fmt.Sprintf("le=%q", le)), 1)
+	m.add(c, m.series("_sum", values), int64(d.Seconds()*sumScale))
+}
+
+// bucketLabel formats the upper bound of a bucket as its "le" label.
+func bucketLabel(b float64) string {
+	return strconv.FormatFloat(b, 'g', -1, 64)
+}
+
+// splitBucket splits the name of a bucket series into the name of the series
+// without its "le" label, and the label's value.
+func splitBucket(name string) (string, string) {
+	i := strings.LastIndex(name, `le="`)
+	if i < 0 {
+		return name, ""
+	}
+	le := strings.TrimSuffix(name[i+len(`le="`):], `"}`)
+	base := strings.TrimRight(name[:i], ",{")
+	if strings.Contains(base, "{") {
+		base += "}"
+	}
+	return base, le
+}
+
+// add adds delta to a series, indexing it the first time it's seen.
+func (m *metric) add(c appengine.Context, series string, delta int64) {
+	key := "metric:" + series
+	if _, err := memcache.Increment(c, key, delta, 0); err != nil {
+		c.Errorf("Unable to update metric %s: %v", series, err)
+		return
+	}
+	seriesMu.Lock()
+	known := seriesKnown[key]
+	seriesKnown[key] = true
+	seriesMu.Unlock()
+	if !known {
+		k := datastore.NewKey(c, "MetricSeries", key, 0, nil)
+		if _, err := datastore.Put(c, k, &MetricSeries{Metric: m.name}); err != nil {
+			c.Errorf("Unable to index metric %s: %v", series, err)
+		}
+	}
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// instrumented counts the requests served by the handler and how long they
+// take.
+func instrumented(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		c := newContext(r)
+		rec := &statusRecorder{w, http.StatusOK}
+		h(rec, r)
+		httpRequests.inc(c, name, strconv.Itoa(rec.code))
+		httpDuration.observe(c, time.Since(start), name)
+	}
+}
+
+// metricsTransport records the outcome and latency of Mirror API requests.
+// Calls sent in batch requests are counted by mirrorBatch.
+type metricsTransport struct {
+	Context   appengine.Context
+	Transport http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op, ok := mirrorRequestOperation(req)
+	if !ok && req.URL.String() == batchEndpoint {
+		op, ok = "POST batch", true
+	}
+	if !ok {
+		return t.Transport.RoundTrip(req)
+	}
+	start := time.Now()
+	resp, err := t.Transport.RoundTrip(req)
+	mirrorDuration.observe(t.Context, time.Since(start), op)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	countMirrorCall(t.Context, op, code)
+	return resp, err
+}
+
+// countMirrorCall counts a Mirror API call that completed with the status code.
+func countMirrorCall(c appengine.Context, op, code string) {
+	mirrorCalls.inc(c, op, code)
+	if op == "POST timeline" && code == "200" {
+		cardsInserted.inc(c)
+	}
+}
+
+// metricsHandler writes all metrics in the Prometheus text exposition format.
+// Scrapers must send metricsToken as a bearer token; scrapes are refused while
+// it isn't set.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	defer context.Clear(r)
+	c := newContext(r)
+	if metricsToken == "" || strings.HasPrefix(metricsToken, "[[") {
+		c.Errorf("Set metricsToken in config.go to enable /metrics")
+		http.Error(w, "", http.StatusServiceUnavailable)
+		return
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+metricsToken)) != 1 {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+
+	var index []MetricSeries
+	keys, err := datastore.NewQuery("MetricSeries").GetAll(c, &index)
+	if err != nil {
+		c.Errorf("Unable to list metrics: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	byMetric := make(map[string][]string)
+	memcacheKeys := make([]string, len(keys))
+	for i, k := range keys {
+		memcacheKeys[i] = k.StringID()
+		byMetric[index[i].Metric] = append(byMetric[index[i].Metric], k.StringID())
+	}
+	values, err := memcache.GetMulti(c, memcacheKeys)
+	if err != nil {
+		c.Errorf("Unable to read metrics: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	for _, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		series := byMetric[m.name]
+		sort.Strings(series)
+		buckets := make(map[string]map[string]int64)
+		var histograms []string
+		for _, key := range series {
+			item, ok := values[key]
+			if !ok {
+				continue // Evicted, the series restarts from zero.
+			}
+			n, err := strconv.ParseInt(string(item.Value), 10, 64)
+			if err != nil {
+				continue
+			}
+			name := strings.TrimPrefix(key, "metric:")
+			switch {
+			case strings.HasPrefix(name, m.name+"_bucket"):
+				base, le := splitBucket(name)
+				if buckets[base] == nil {
+					buckets[base] = make(map[string]int64)
+					histograms = append(histograms, base)
+				}
+				buckets[base][le] = n
+			case strings.HasPrefix(name, m.name+"_sum"):
+				fmt.Fprintf(bw, "%s %g\n", name, float64(n)/sumScale)
+			default:
+				fmt.Fprintf(bw, "%s %d\n", name, n)
+			}
+		}
+		for _, base := range histograms {
+			writeBuckets(bw, m, base, buckets[base])
+		}
+	}
+}
+
+// writeBuckets writes the cumulative buckets and the count of a histogram
+// series, given the number of observations in each bucket.
+func writeBuckets(w io.Writer, m *metric, base string, counts map[string]int64) {
+	labels := strings.TrimPrefix(base, m.name+"_bucket")
+	withLe := func(le string) string {
+		if labels == "" {
+			return fmt.Sprintf("{le=%q}", le)
+		}
+		return fmt.Sprintf("%s,le=%q}", strings.TrimSuffix(labels, "}"), le)
+	}
+	var total int64
+	for _, b := range m.bucket {
+		total += counts[bucketLabel(b)]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, withLe(bucketLabel(b)), total)
+	}
+	total += counts["+Inf"]
+	fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, withLe("+Inf"), total)
+	fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, total)
+}
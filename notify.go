@@ -19,9 +19,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
-	"code.google.com/p/goauth2/oauth"
 	"code.google.com/p/google-api-go-client/mirror/v1"
+	"github.com/gorilla/context"
 
 	"appengine"
 	"appengine/taskqueue"
@@ -30,17 +31,17 @@ import (
 // Because App Engine owns main and starts the HTTP service,
 // we do our setup during initialization.
 func init() {
-	http.HandleFunc("/notify", errorAdapter(notifyHandler))
-	http.HandleFunc("/processnotification", notifyProcessorHandler)
+	http.HandleFunc("/notify", instrumented("notify", errorAdapter(notifyHandler)))
+	http.HandleFunc("/processnotification", instrumented("processnotification", notifyProcessorHandler))
 }
 
 // notifyHandler starts a new Task Queue to process the notification ping.
 func notifyHandler(w http.ResponseWriter, r *http.Request) error {
-	c := appengine.NewContext(r)
+	c := newContext(r)
 	t := &taskqueue.Task{
 		Path:   "/processnotification",
 		Method: "POST",
-		Header: r.Header,
+		Header: http.Header{"Content-Type": {r.Header.Get("Content-Type")}},
 	}
 	payload, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -48,7 +49,7 @@ func notifyHandler(w http.ResponseWriter, r *http.Request) error {
 	}
 	t.Payload = payload
 	// Insert a new Task in the default Task Queue.
-	if _, err = taskqueue.Add(c, t, ""); err != nil {
+	if err = addTask(c, t); err != nil {
 		return fmt.Errorf("Failed to add new task: %s", err)
 	}
 	return nil
@@ -56,7 +57,8 @@ func notifyHandler(w http.ResponseWriter, r *http.Request) error {
 
 // notifyProcessorHandler processes notification pings from the API in a Task Queue.
 func notifyProcessorHandler(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	defer context.Clear(r)
+	c := newContext(r)
 
 	not := new(mirror.Notification)
 	if err := json.NewDecoder(r.Body).Decode(not); err != nil {
@@ -70,21 +72,38 @@ func notifyProcessorHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	svc, _ := mirror.New(t.Client())
+	// Pipelines reuse helpers of authenticated handlers.
+	setCurrentUser(r, userId, t, svc)
 
 	var err error
+	start := time.Now()
+	e := &AuditEntry{
+		Actor:     actorNotification,
+		UserId:    userId,
+		Operation: "notification." + not.Collection,
+		Resources: []string{not.ItemId},
+	}
 	if not.Collection == "locations" {
-		err = handleLocationsNotification(c, svc, not)
+		err = handleLocationsNotification(c, svc, not, e)
 	} else if not.Collection == "timeline" {
-		err = handleTimelineNotification(c, svc, not, t)
+		err = handleTimelineNotification(c, r, svc, not, e)
 	}
 	if err != nil {
 		c.Errorf("Error occured while processing notification: %s", err)
 	}
+	audit(c, e, err, time.Since(start))
+	invalidateDashboard(c, userId)
+	notificationDuration.observe(c, time.Since(start), not.Collection)
 }
 
-// handleLocationsNotification processes a location notification.
-func handleLocationsNotification(c appengine.Context, svc *mirror.Service, not *mirror.Notification) error {
-	l, err := svc.Locations.Get(not.ItemId).Do()
+// handleLocationsNotification processes a location notification. The IDs of
+// the resources it creates are added to the audit entry.
+func handleLocationsNotification(c appengine.Context, svc *mirror.Service, not *mirror.Notification, e *AuditEntry) error {
+	var l *mirror.Location
+	err := mirrorCall(c, "locations.get", func() (err error) {
+		l, err = svc.Locations.Get(not.ItemId).Do()
+		return
+	})
 	if err != nil {
 		return fmt.Errorf("Unable to retrieve location: %s", err)
 	}
@@ -95,33 +114,39 @@ func handleLocationsNotification(c appengine.Context, svc *mirror.Service, not *
 		MenuItems:    []*mirror.MenuItem{&mirror.MenuItem{Action: "NAVIGATE"}},
 		Notification: &mirror.NotificationConfig{Level: "DEFAULT"},
 	}
-	_, err = svc.Timeline.Insert(t).Do()
+	var item *mirror.TimelineItem
+	err = mirrorCall(c, "timeline.insert", func() (err error) {
+		item, err = svc.Timeline.Insert(t).Do()
+		return
+	})
 	if err != nil {
 		return fmt.Errorf("Unable to insert timeline item: %s", err)
 	}
+	e.Resources = append(e.Resources, item.Id)
 	return nil
 }
 
-// handleTimelineNotification processes a timeline notification.
-func handleTimelineNotification(c appengine.Context, svc *mirror.Service, not *mirror.Notification, transport *oauth.Transport) error {
+// handleTimelineNotification processes a timeline notification. Shared items
+// are routed to the pipelines of the contacts they were shared with. The
+// actions it handles and the resources the pipelines create are added to the
+// audit entry.
+func handleTimelineNotification(c appengine.Context, r *http.Request, svc *mirror.Service, not *mirror.Notification, e *AuditEntry) error {
 	for _, ua := range not.UserActions {
 		if ua.Type != "SHARE" {
 			c.Infof("I don't know what to do with this notification: %+v", ua)
 			continue
 		}
-		t, err := svc.Timeline.Get(not.ItemId).Do()
+		e.Operation = "notification.timeline." + ua.Type
+		var t *mirror.TimelineItem
+		err := mirrorCall(c, "timeline.get", func() (err error) {
+			t, err = svc.Timeline.Get(not.ItemId).Do()
+			return
+		})
 		if err != nil {
 			return fmt.Errorf("Unable to retrieve timeline item: %s", err)
 		}
-		// We could have just updated the Text attribute in-place and used the
-		// Update method instead, but we wanted to illustrate the Patch method
-		// here.
-		patch := &mirror.TimelineItem{
-			Text: fmt.Sprintf("Go Quick Start got your photo! %s", t.Text),
-		}
-		_, err = svc.Timeline.Patch(not.ItemId, patch).Do()
-		if err != nil {
-			return fmt.Errorf("Unable to patch timeline item: %s", err)
+		if err = routeSharedItem(c, r, currentUser(r), t, e); err != nil {
+			return fmt.Errorf("Unable to process shared item: %s", err)
 		}
 	}
 	return nil
@@ -0,0 +1,369 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.google.com/p/google-api-go-client/googleapi"
+	"code.google.com/p/google-api-go-client/mirror/v1"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+)
+
+// Status of an onboarding step.
+const (
+	stepPending = "pending"
+	stepDone    = "done"
+	stepSkipped = "skipped"
+	stepFailed  = "failed"
+)
+
+// Source item ID of the welcome card, used to find it if the batch inserting
+// it failed after the card was created.
+const welcomeSourceItemId = "Go_Quick_Start_welcome"
+
+var (
+	// errSkipStep is returned by steps that cannot run in this environment.
+	errSkipStep = errors.New("step skipped")
+	// errStepDone is returned by steps that find what they set up already
+	// exists, for instance because an earlier attempt failed after the API
+	// carried it out.
+	errStepDone = errors.New("step already done")
+)
+
+// onboardingStep is one step of setting up a new user's Glass. The pending
+// steps are sent together in a batch request. Inserts aren't retried when
+// they fail ambiguously, so each step checks whether it already ran first.
+type onboardingStep struct {
+	name string
+	call func(c appengine.Context, svc *mirror.Service, o *Onboarding, s *OnboardingStep) (*batchCall, error)
+}
+
+// Steps run for every new user, in order. Edit this list to change what the
+// app sets up on sign-in.
+var onboardingSteps = []onboardingStep{
+	{"timelineSubscription", subscribeTimeline},
+	{"contact", insertAppContact},
+	{"welcomeCard", insertWelcomeCard},
+}
+
+// Onboarding tracks the setup of a new user's Glass.
+type Onboarding struct {
+	UserId  string
+	Host    string // Host the user signed in on, used to build callback URLs.
+	Steps   []OnboardingStep
+	Created time.Time
+	Updated time.Time
+}
+
+// OnboardingStep records the progress of one step.
+type OnboardingStep struct {
+	Name      string
+	Status    string
+	Attempts  int
+	LastError string `datastore:",noindex"`
+	Resource  string `datastore:",noindex"` // ID of what the step created.
+	Updated   time.Time
+}
+
+// fail records a failed attempt at the step and reports whether it can be
+// retried, or else marks it failed.
+func (s *OnboardingStep) fail(err error) bool {
+	s.LastError = err.Error()
+	if s.Attempts >= onboardingMaxAttempts {
+		s.Status = stepFailed
+		return false
+	}
+	return true
+}
+
+// Complete reports whether no step is left to run or retry.
+func (o *Onboarding) Complete() bool {
+	for _, s := range o.Steps {
+		if s.Status == stepPending || s.Status == stepFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed reports whether a step has run out of attempts.
+func (o *Onboarding) Failed() bool {
+	for _, s := range o.Steps {
+		if s.Status == stepFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// syncSteps matches the stored steps to onboardingSteps by name, so that the
+// list can be edited while users are being onboarded. New steps are added as
+// pending and removed ones are dropped.
+func (o *Onboarding) syncSteps(now time.Time) {
+	stored := make(map[string]OnboardingStep)
+	for _, s := range o.Steps {
+		stored[s.Name] = s
+	}
+	o.Steps = make([]OnboardingStep, len(onboardingSteps))
+	for i, step := range onboardingSteps {
+		s, ok := stored[step.name]
+		if !ok {
+			s = OnboardingStep{Name: step.name, Status: stepPending, Updated: now}
+		}
+		o.Steps[i] = s
+	}
+}
+
+// Because App Engine owns main and starts the HTTP service,
+// we do our setup during initialization.
+func init() {
+	http.HandleFunc("/tasks/onboard", errorAdapter(onboardHandler))
+}
+
+// startOnboarding records the onboarding steps for a new user and starts a task
+// to run them.
+func startOnboarding(c appengine.Context, host, userId string) error {
+	now := time.Now()
+	o := &Onboarding{UserId: userId, Host: host, Created: now, Updated: now}
+	o.syncSteps(now)
+	if err := putOnboarding(c, o); err != nil {
+		return err
+	}
+	return enqueueOnboarding(c, userId)
+}
+
+// enqueueOnboarding adds a task running the user's pending onboarding steps.
+func enqueueOnboarding(c appengine.Context, userId string) error {
+	return addTask(c, taskqueue.NewPOSTTask("/tasks/onboard", url.Values{"userId": {userId}}))
+}
+
+// onboardingStatus returns the user's onboarding, or nil if there is none.
+func onboardingStatus(c appengine.Context, userId string) (*Onboarding, error) {
+	o := new(Onboarding)
+	err := datastore.Get(c, datastore.NewKey(c, "Onboarding", userId, 0, nil), o)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// putOnboarding stores the user's onboarding in the datastore.
+func putOnboarding(c appengine.Context, o *Onboarding) error {
+	o.Updated = time.Now()
+	_, err := datastore.Put(c, datastore.NewKey(c, "Onboarding", o.UserId, 0, nil), o)
+	return err
+}
+
+// onboardHandler runs the pending onboarding steps of a user. It fails while
+// a step can still be retried so that the Task Queue runs it again later.
+func onboardHandler(w http.ResponseWriter, r *http.Request) error {
+	c := newContext(r)
+	userId := r.FormValue("userId")
+	o, err := onboardingStatus(c, userId)
+	if err != nil {
+		return fmt.Errorf("Unable to retrieve onboarding: %s", err)
+	}
+	if o == nil {
+		c.Errorf("No onboarding for user ID: %s", userId)
+		return nil
+	}
+	t := authTransport(c, userId)
+	if t == nil {
+		c.Errorf("Unknown user ID: %s", userId)
+		return nil
+	}
+	svc, err := mirror.New(t.Client())
+	if err != nil {
+		return fmt.Errorf("Unable to create Mirror service: %s", err)
+	}
+
+	o.syncSteps(time.Now())
+	retry := false
+	var steps []*OnboardingStep
+	var calls []*batchCall
+	for i, step := range onboardingSteps {
+		s := &o.Steps[i]
+		if s.Status != stepPending {
+			continue
+		}
+		s.Attempts++
+		s.Updated = time.Now()
+		call, err := step.call(c, svc, o, s)
+		if err == errSkipStep {
+			s.Status, s.LastError = stepSkipped, ""
+			continue
+		}
+		if err == errStepDone {
+			s.Status, s.LastError = stepDone, ""
+			continue
+		}
+		if err != nil {
+			c.Errorf("Unable to prepare onboarding step %s: %s", s.Name, err)
+			if s.fail(err) {
+				retry = true
+			}
+			continue
+		}
+		steps = append(steps, s)
+		calls = append(calls, call)
+	}
+
+	for i, res := range mirrorBatch(c, t.Client(), calls) {
+		s := steps[i]
+		err := res.Err
+		if err == nil {
+			var created struct{ Id string }
+			res.decode(&created)
+			audit(c, &AuditEntry{
+				Actor:     actorTask,
+				UserId:    userId,
+				Operation: "onboarding." + s.Name,
+				Resources: []string{created.Id},
+			}, nil, 0)
+			s.Status, s.LastError, s.Resource = stepDone, "", created.Id
+			continue
+		}
+		c.Errorf("Onboarding step %s failed: %s", s.Name, err)
+		audit(c, &AuditEntry{Actor: actorTask, UserId: userId, Operation: "onboarding." + s.Name}, err, 0)
+		if s.fail(err) {
+			retry = true
+		}
+	}
+	invalidateDashboard(c, userId)
+	if err = putOnboarding(c, o); err != nil {
+		return fmt.Errorf("Unable to store onboarding: %s", err)
+	}
+	if retry {
+		return errors.New("Some onboarding steps will be retried")
+	}
+	return nil
+}
+
+// retryOnboarding resets the failed onboarding steps of the current user and
+// runs them again.
+func retryOnboarding(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
+	userId := currentUser(r)
+	o, err := onboardingStatus(c, userId)
+	if err != nil {
+		return nil, wrapError(err, "Unable to retrieve onboarding")
+	}
+	if o == nil {
+		return &operationResult{"There is nothing to set up.", flashInfo}, nil
+	}
+	for i := range o.Steps {
+		if o.Steps[i].Status == stepFailed {
+			o.Steps[i].Status = stepPending
+			o.Steps[i].Attempts = 0
+		}
+	}
+	if err = putOnboarding(c, o); err != nil {
+		return nil, wrapError(err, "Unable to store onboarding")
+	}
+	if err = enqueueOnboarding(c, userId); err != nil {
+		return nil, wrapError(err, "Unable to start onboarding")
+	}
+	return done("Setup of your Glass has been restarted."), nil
+}
+
+// subscribeTimeline subscribes the app to the user's timeline notifications,
+// unless it already is. Subscriptions require an HTTPS callback, so the step is
+// skipped elsewhere.
+func subscribeTimeline(c appengine.Context, svc *mirror.Service, o *Onboarding, s *OnboardingStep) (*batchCall, error) {
+	callbackUrl := fullURL(o.Host, "/notify")
+	if !strings.HasPrefix(callbackUrl, "https://") {
+		c.Infof("Subscriptions are not supported on %s", o.Host)
+		return nil, errSkipStep
+	}
+	var l *mirror.SubscriptionsListResponse
+	err := mirrorCall(c, "subscriptions.list", func() (err error) {
+		l, err = svc.Subscriptions.List().Do()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range l.Items {
+		if sub.Collection == "timeline" {
+			s.Resource = sub.Id
+			return nil, errStepDone
+		}
+	}
+	sub := &mirror.Subscription{
+		Collection:  "timeline",
+		UserToken:   o.UserId,
+		CallbackUrl: callbackUrl,
+	}
+	return &batchCall{UserId: o.UserId, Method: "POST", Path: "subscriptions", Body: sub}, nil
+}
+
+// insertAppContact inserts the contact users share items with, or updates it
+// if it exists.
+func insertAppContact(c appengine.Context, svc *mirror.Service, o *Onboarding, s *OnboardingStep) (*batchCall, error) {
+	ct := &mirror.Contact{
+		Id:          "Go_Quick_Start",
+		DisplayName: "Go Quick Start",
+		ImageUrls:   []string{fullURL(o.Host, "/static/images/gopher.png")},
+	}
+	err := mirrorCall(c, "contacts.get", func() error {
+		_, err := svc.Contacts.Get(ct.Id).Do()
+		return err
+	})
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return &batchCall{UserId: o.UserId, Method: "POST", Path: "contacts", Body: ct}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &batchCall{UserId: o.UserId, Method: "PUT", Path: "contacts/" + url.QueryEscape(ct.Id), Body: ct}, nil
+}
+
+// insertWelcomeCard inserts the welcome message in the user's timeline, once.
+// The card is tagged with welcomeSourceItemId to find it again.
+func insertWelcomeCard(c appengine.Context, svc *mirror.Service, o *Onboarding, s *OnboardingStep) (*batchCall, error) {
+	if s.Resource != "" {
+		return nil, errStepDone
+	}
+	var l *mirror.TimelineListResponse
+	err := mirrorCall(c, "timeline.list", func() (err error) {
+		l, err = svc.Timeline.List().SourceItemId(welcomeSourceItemId).Do()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(l.Items) > 0 {
+		s.Resource = l.Items[0].Id
+		return nil, errStepDone
+	}
+	t := &mirror.TimelineItem{
+		Text:         "Welcome to the Go Quick Start",
+		SourceItemId: welcomeSourceItemId,
+		Notification: &mirror.NotificationConfig{Level: "DEFAULT"},
+	}
+	return &batchCall{UserId: o.UserId, Method: "POST", Path: "timeline", Body: t}, nil
+}
@@ -0,0 +1,398 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"fmt"
+	"html/template"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+// Kinds of quota counters.
+const (
+	quotaGlobal    = "global"
+	quotaUser      = "user"
+	quotaOperation = "operation"
+)
+
+// QuotaShard is one shard of a daily counter of Mirror API calls.
+type QuotaShard struct {
+	Kind  string // One of quotaGlobal, quotaUser or quotaOperation.
+	Name  string // User ID or operation; empty for the global counter.
+	Day   string
+	Count int64
+}
+
+// QuotaPending marks a shard of a counter with calls counted in memcache but
+// not yet flushed to the datastore. Markers are keyed like the shards.
+type QuotaPending struct {
+	Kind string
+	Name string
+	Day  string
+}
+
+// quotaCounter identifies a daily counter.
+type quotaCounter struct {
+	kind, name, day string
+}
+
+func (q quotaCounter) String() string {
+	return fmt.Sprintf("%s:%s:%s", q.kind, q.name, q.day)
+}
+
+// limit returns the configured limit of the counter, or 0 if there is none.
+func (q quotaCounter) limit() int64 {
+	switch q.kind {
+	case quotaGlobal:
+		return quotaDailyLimit
+	case quotaUser:
+		return quotaUserDailyLimit
+	}
+	return quotaOperationLimits[q.name]
+}
+
+// quotaError is returned instead of making a call that would exceed a limit.
+type quotaError struct {
+	counter quotaCounter
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("Daily quota exceeded for %s %s", e.counter.kind, e.counter.name)
+}
+
+var quotaTmpl = template.Must(template.ParseFiles("quota.html"))
+
+// Because App Engine owns main and starts the HTTP service,
+// we do our setup during initialization.
+func init() {
+	http.HandleFunc("/admin/quota", errorAdapter(quotaHandler))
+	http.HandleFunc("/tasks/quota/flush", errorAdapter(quotaFlushHandler))
+}
+
+// quotaDay returns the day quota is currently counted for. Days are in UTC.
+func quotaDay() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// quotaCounters returns the counters charged by a call of op for the user.
+func quotaCounters(userId, op string) []quotaCounter {
+	day := quotaDay()
+	counters := []quotaCounter{
+		{quotaGlobal, "", day},
+		{quotaOperation, op, day},
+	}
+	if userId != "" {
+		counters = append(counters, quotaCounter{quotaUser, userId, day})
+	}
+	return counters
+}
+
+// chargeQuota checks that a call of op for the user stays within the limits
+// and counts it. It returns a *quotaError if the call should not be made.
+// Calls are counted in a random shard of each counter in memcache, which
+// quotaFlushHandler adds to the datastore; calls counted in memcache entries
+// evicted before then are lost.
+func chargeQuota(c appengine.Context, userId, op string) error {
+	counters := quotaCounters(userId, op)
+	for _, q := range counters {
+		if l := q.limit(); l > 0 && quotaCount(c, q) >= l {
+			return &quotaError{q}
+		}
+	}
+	shard := rand.Intn(quotaShards)
+	for _, q := range counters {
+		n, err := memcache.Increment(c, quotaPendingKey(q, shard), 1, 0)
+		if err != nil {
+			// Don't fail the call because it couldn't be counted.
+			c.Errorf("Unable to count API call: %v", err)
+			return nil
+		}
+		if n == 1 {
+			if err = markQuotaPending(c, q, shard); err != nil {
+				c.Errorf("Unable to mark API calls for flushing: %v", err)
+			}
+		}
+		memcache.IncrementExisting(c, "quota:"+q.String(), 1)
+	}
+	return nil
+}
+
+// quotaShardKey returns the key of a shard of the counter.
+func quotaShardKey(c appengine.Context, q quotaCounter, shard int) *datastore.Key {
+	return datastore.NewKey(c, "QuotaShard", q.String()+":"+strconv.Itoa(shard), 0, nil)
+}
+
+// quotaPendingKey returns the memcache key of the calls counted in a shard of
+// the counter since it was last flushed.
+func quotaPendingKey(q quotaCounter, shard int) string {
+	return "quota:pending:" + q.String() + ":" + strconv.Itoa(shard)
+}
+
+// markQuotaPending records that a shard of the counter has calls to flush.
+func markQuotaPending(c appengine.Context, q quotaCounter, shard int) error {
+	key := datastore.NewKey(c, "QuotaPending", q.String()+":"+strconv.Itoa(shard), 0, nil)
+	_, err := datastore.Put(c, key, &QuotaPending{q.kind, q.name, q.day})
+	return err
+}
+
+// pendingShard returns the shard of a QuotaPending marker.
+func pendingShard(key *datastore.Key) int {
+	name := key.StringID()
+	shard, _ := strconv.Atoi(name[strings.LastIndex(name, ":")+1:])
+	return shard
+}
+
+// quotaFlushHandler adds the calls counted in memcache to the datastore
+// shards, and deletes counters older than quotaRetention days. It is run every
+// minute by cron.
+func quotaFlushHandler(w http.ResponseWriter, r *http.Request) error {
+	c := newContext(r)
+	var pending []QuotaPending
+	keys, err := datastore.NewQuery("QuotaPending").GetAll(c, &pending)
+	if err != nil {
+		return fmt.Errorf("Unable to list quota counters: %s", err)
+	}
+	for i, p := range pending {
+		q := quotaCounter{p.Kind, p.Name, p.Day}
+		if err = flushQuotaShard(c, keys[i], q, pendingShard(keys[i])); err != nil {
+			c.Errorf("Unable to flush quota counter %s: %v", keys[i].StringID(), err)
+		}
+	}
+
+	oldest := time.Now().UTC().AddDate(0, 0, -quotaRetention).Format("2006-01-02")
+	expired, err := datastore.NewQuery("QuotaShard").Filter("Day <", oldest).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to list expired quota counters: %s", err)
+	}
+	return datastore.DeleteMulti(c, expired)
+}
+
+// flushQuotaShard moves the calls counted in memcache for a shard of the
+// counter to the datastore. The marker is removed first so that calls counted
+// meanwhile mark the shard again. The memcache count is only decremented once
+// the datastore has recorded the calls, so that failures can over-count but
+// never lose calls.
+func flushQuotaShard(c appengine.Context, marker *datastore.Key, q quotaCounter, shard int) error {
+	if err := datastore.Delete(c, marker); err != nil {
+		return err
+	}
+	item, err := memcache.Get(c, quotaPendingKey(q, shard))
+	if err == memcache.ErrCacheMiss {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	n, err := strconv.ParseInt(string(item.Value), 10, 64)
+	if err != nil || n <= 0 {
+		return err
+	}
+	key := quotaShardKey(c, q, shard)
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		s := new(QuotaShard)
+		if err := datastore.Get(tc, key, s); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		s.Kind, s.Name, s.Day = q.kind, q.name, q.day
+		s.Count += n
+		_, err := datastore.Put(tc, key, s)
+		return err
+	}, nil)
+	if err != nil {
+		// Leave the calls for the next flush.
+		if err := markQuotaPending(c, q, shard); err != nil {
+			c.Errorf("Unable to mark quota counter: %v", err)
+		}
+		return err
+	}
+	left, err := memcache.Increment(c, quotaPendingKey(q, shard), -n, 0)
+	if err != nil || left == 0 {
+		return err
+	}
+	return markQuotaPending(c, q, shard)
+}
+
+// quotaCount returns the value of the counter, from memcache if possible.
+func quotaCount(c appengine.Context, q quotaCounter) int64 {
+	if item, err := memcache.Get(c, "quota:"+q.String()); err == nil {
+		if n, err := strconv.ParseInt(string(item.Value), 10, 64); err == nil {
+			return n
+		}
+	}
+	keys := make([]*datastore.Key, quotaShards)
+	pendingKeys := make([]string, quotaShards)
+	for i := range keys {
+		keys[i] = quotaShardKey(c, q, i)
+		pendingKeys[i] = quotaPendingKey(q, i)
+	}
+	shards := make([]QuotaShard, quotaShards)
+	datastore.GetMulti(c, keys, shards) // Missing shards are left at zero.
+	var total int64
+	for _, s := range shards {
+		total += s.Count
+	}
+	// Add the calls not flushed yet.
+	pending, _ := memcache.GetMulti(c, pendingKeys)
+	for _, item := range pending {
+		if n, err := strconv.ParseInt(string(item.Value), 10, 64); err == nil {
+			total += n
+		}
+	}
+	memcache.Add(c, &memcache.Item{
+		Key:        "quota:" + q.String(),
+		Value:      []byte(strconv.FormatInt(total, 10)),
+		Expiration: 24 * time.Hour,
+	})
+	return total
+}
+
+// quotaRemaining returns how many calls can still be made today.
+func quotaRemaining(c appengine.Context) int64 {
+	return quotaDailyLimit - quotaCount(c, quotaCounter{quotaGlobal, "", quotaDay()})
+}
+
+// mirrorOperation names the API operation of a request to a Mirror path, such
+// as "DELETE timeline" for "timeline/<id>".
+func mirrorOperation(method, path string) string {
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	var resources []string
+	for i := 0; i < len(segments); i += 2 {
+		resources = append(resources, segments[i])
+	}
+	return method + " " + strings.Join(resources, ".")
+}
+
+// quotaTransport counts the Mirror API requests made for a user and refuses
+// those over quota. Batch requests are counted by mirrorBatch instead.
+type quotaTransport struct {
+	Context   appengine.Context
+	UserId    string
+	Transport http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Chunks of a resumable upload belong to the call that started it.
+	resumed := req.URL.Query().Get("upload_id") != ""
+	if op, ok := mirrorRequestOperation(req); ok && !resumed {
+		if err := chargeQuota(t.Context, t.UserId, op); err != nil {
+			return nil, err
+		}
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+// mirrorRequestOperation returns the Mirror API operation of a request, if it
+// is a request to the Mirror API other than a batch request.
+func mirrorRequestOperation(req *http.Request) (string, bool) {
+	if req.URL.Host != "www.googleapis.com" {
+		return "", false
+	}
+	for _, prefix := range []string{"/mirror/v1/", "/upload/mirror/v1/"} {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return mirrorOperation(req.Method, req.URL.Path[len(prefix):]), true
+		}
+	}
+	return "", false
+}
+
+// quotaUsage is a row of the quota dashboard.
+type quotaUsage struct {
+	Name  string
+	Count int64
+	Limit int64
+}
+
+// Percent returns the share of the limit used so far.
+func (u quotaUsage) Percent() int64 {
+	if u.Limit == 0 {
+		return 0
+	}
+	return 100 * u.Count / u.Limit
+}
+
+// quotaHandler shows today's API consumption against the configured limits.
+func quotaHandler(w http.ResponseWriter, r *http.Request) error {
+	c := newContext(r)
+	day := quotaDay()
+	var shards []QuotaShard
+	if _, err := datastore.NewQuery("QuotaShard").Filter("Day =", day).GetAll(c, &shards); err != nil {
+		return fmt.Errorf("Unable to retrieve quota: %s", err)
+	}
+	totals := map[string]map[string]int64{
+		quotaGlobal:    {},
+		quotaUser:      {},
+		quotaOperation: {},
+	}
+	for _, s := range shards {
+		if t, ok := totals[s.Kind]; ok {
+			t[s.Name] += s.Count
+		}
+	}
+	// Add the calls counted in memcache and not flushed yet.
+	var pending []QuotaPending
+	keys, err := datastore.NewQuery("QuotaPending").Filter("Day =", day).GetAll(c, &pending)
+	if err != nil {
+		return fmt.Errorf("Unable to retrieve quota: %s", err)
+	}
+	pendingKeys := make([]string, len(pending))
+	for i, p := range pending {
+		pendingKeys[i] = quotaPendingKey(quotaCounter{p.Kind, p.Name, p.Day}, pendingShard(keys[i]))
+	}
+	items, _ := memcache.GetMulti(c, pendingKeys)
+	for i, p := range pending {
+		item, ok := items[pendingKeys[i]]
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseInt(string(item.Value), 10, 64); err == nil {
+			if t, ok := totals[p.Kind]; ok {
+				t[p.Name] += n
+			}
+		}
+	}
+	rows := func(kind string) []quotaUsage {
+		var usage []quotaUsage
+		for name, count := range totals[kind] {
+			usage = append(usage, quotaUsage{name, count, quotaCounter{kind, name, day}.limit()})
+		}
+		sort.Sort(byCount(usage))
+		return usage
+	}
+	return quotaTmpl.Execute(w, map[string]interface{}{
+		"Day":        day,
+		"Global":     quotaUsage{"All calls", totals[quotaGlobal][""], quotaDailyLimit},
+		"Users":      rows(quotaUser),
+		"Operations": rows(quotaOperation),
+	})
+}
+
+// byCount sorts usage by decreasing count.
+type byCount []quotaUsage
+
+func (u byCount) Len() int           { return len(u) }
+func (u byCount) Less(i, j int) bool { return u[i].Count > u[j].Count }
+func (u byCount) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
@@ -0,0 +1,560 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/google-api-go-client/googleapi"
+	"code.google.com/p/google-api-go-client/mirror/v1"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+)
+
+const resumableEndpoint = "https://www.googleapis.com/upload/mirror/v1/timeline?uploadType=resumable"
+
+// Status of a resumable upload.
+const (
+	uploadPending  = "pending"
+	uploadDone     = "done"
+	uploadFailed   = "failed"
+	uploadCanceled = "canceled" // Until the upload is deleted.
+)
+
+var (
+	errUploadPaused   = errors.New("Upload paused")
+	errUploadExpired  = errors.New("Upload session expired")
+	errUploadCanceled = errors.New("Upload canceled")
+)
+
+// ResumableUpload tracks a media file sent to the Mirror API with the
+// resumable upload protocol from a task. The file is stored in UploadChunk
+// entities under it until the upload is done, and uploads are stored under an
+// UploadQueue key per user like flash messages.
+type ResumableUpload struct {
+	ID          int64 `datastore:"-"`
+	Name        string
+	ContentType string
+	Text        string `datastore:",noindex"` // Text of the inserted card.
+	Size        int64
+	Chunks      int
+	SessionURI  string `datastore:",noindex"` // Empty until the upload starts.
+	Offset      int64  // Bytes received by the Mirror API so far.
+	Status      string
+	Attempts    int    // Failed attempts so far.
+	LastError   string `datastore:",noindex"`
+	ItemId      string
+	Created     time.Time
+	Updated     time.Time
+}
+
+// UploadChunk is resumableChunkSize bytes of a resumable upload, the last
+// chunk being shorter.
+type UploadChunk struct {
+	Data []byte
+}
+
+// Percent returns the share of the file received by the Mirror API.
+func (u *ResumableUpload) Percent() int64 {
+	if u.Size == 0 {
+		return 0
+	}
+	return 100 * u.Offset / u.Size
+}
+
+// Because App Engine owns main and starts the HTTP service,
+// we do our setup during initialization.
+func init() {
+	http.HandleFunc("/api/upload/resumable", instrumented("upload.resumable", errorAdapter(authenticated(resumableUploadHandler))))
+	http.HandleFunc("/api/uploads", instrumented("uploads", errorAdapter(authenticated(uploadsHandler))))
+	http.HandleFunc("/tasks/upload", errorAdapter(uploadTaskHandler))
+}
+
+// uploadQueueKey returns the parent key of the user's uploads.
+func uploadQueueKey(c appengine.Context, userId string) *datastore.Key {
+	return datastore.NewKey(c, "UploadQueue", userId, 0, nil)
+}
+
+// uploadKey returns the key of one of the user's uploads.
+func uploadKey(c appengine.Context, userId string, id int64) *datastore.Key {
+	return datastore.NewKey(c, "ResumableUpload", "", id, uploadQueueKey(c, userId))
+}
+
+// startResumableUpload stores the file and starts a task sending it to the
+// Mirror API as a new card with the text.
+func startResumableUpload(c appengine.Context, userId, text string, m *upload) (*ResumableUpload, error) {
+	now := time.Now()
+	u := &ResumableUpload{
+		Name:        m.Name,
+		ContentType: m.ContentType,
+		Text:        text,
+		Size:        int64(len(m.Data)),
+		Chunks:      (len(m.Data) + resumableChunkSize - 1) / resumableChunkSize,
+		Status:      uploadPending,
+		Created:     now,
+		Updated:     now,
+	}
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "ResumableUpload", uploadQueueKey(c, userId)), u)
+	if err != nil {
+		return nil, err
+	}
+	u.ID = key.IntID()
+	for i := 0; i < u.Chunks; i++ {
+		end := (i + 1) * resumableChunkSize
+		if end > len(m.Data) {
+			end = len(m.Data)
+		}
+		chunk := &UploadChunk{m.Data[i*resumableChunkSize : end]}
+		if _, err = datastore.Put(c, datastore.NewKey(c, "UploadChunk", "", int64(i+1), key), chunk); err != nil {
+			return nil, err
+		}
+	}
+	return u, enqueueUpload(c, userId, u.ID)
+}
+
+// enqueueUpload adds a task sending one of the user's uploads.
+func enqueueUpload(c appengine.Context, userId string, id int64) error {
+	v := url.Values{"userId": {userId}, "uploadId": {strconv.FormatInt(id, 10)}}
+	return addTask(c, taskqueue.NewPOSTTask("/tasks/upload", v))
+}
+
+// userUploads returns the user's most recent uploads, most recent first.
+func userUploads(c appengine.Context, userId string) ([]*ResumableUpload, error) {
+	var uploads []*ResumableUpload
+	q := datastore.NewQuery("ResumableUpload").Ancestor(uploadQueueKey(c, userId)).Order("-Created").Limit(5)
+	keys, err := q.GetAll(c, &uploads)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		uploads[i].ID = k.IntID()
+	}
+	return uploads, nil
+}
+
+// deleteUploads removes all the user's uploads and their files.
+func deleteUploads(c appengine.Context, userId string) error {
+	keys, err := datastore.NewQuery("").Ancestor(uploadQueueKey(c, userId)).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(c, keys)
+}
+
+// deleteUploadChunks removes the stored file of an upload.
+func deleteUploadChunks(c appengine.Context, key *datastore.Key) error {
+	keys, err := datastore.NewQuery("UploadChunk").Ancestor(key).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(c, keys)
+}
+
+// resumableUploadHandler stores the media file posted to it, either as the
+// "media" file of a multipart form with an optional "text" field or as the
+// request body, and starts sending it to the Mirror API. Pages are sent back
+// to the main page, where progress is shown; other clients get the upload as
+// JSON and can follow it on /api/uploads.
+func resumableUploadHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return &appError{http.StatusMethodNotAllowed, "Uploads must be POSTed.", nil}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, uploadMaxRequest)
+	c := newContext(r)
+	userId := currentUser(r)
+
+	var m *upload
+	var text string
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "multipart/form-data" {
+		if err := r.ParseMultipartForm(uploadMaxMemory); err != nil {
+			return badRequest("Invalid form: %s", err)
+		}
+		text = r.FormValue("text")
+		files := r.MultipartForm.File["media"]
+		if len(files) != 1 {
+			return badRequest("Exactly one media file must be sent.")
+		}
+		f, err := files[0].Open()
+		if err != nil {
+			return wrapError(err, "Unable to read "+files[0].Filename)
+		}
+		m, err = readMedia(files[0].Filename, files[0].Header.Get("Content-Type"), f, resumableMaxBytes)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if m, err = readMedia("The request body", ct, r.Body, resumableMaxBytes); err != nil {
+			return err
+		}
+	}
+
+	u, err := startResumableUpload(c, userId, text, m)
+	if err != nil {
+		return wrapError(err, "Unable to start the upload")
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		pushFlash(c, userId, flashInfo, fmt.Sprintf("%s is being sent to your Glass.", m.Name))
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(w).Encode(uploadStatus(u))
+}
+
+// uploadStatus returns the JSON representation of an upload.
+func uploadStatus(u *ResumableUpload) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       u.ID,
+		"name":     u.Name,
+		"status":   u.Status,
+		"size":     u.Size,
+		"received": u.Offset,
+		"percent":  u.Percent(),
+		"itemId":   u.ItemId,
+		"error":    u.LastError,
+	}
+}
+
+// uploadsHandler lists the current user's recent uploads as JSON.
+func uploadsHandler(w http.ResponseWriter, r *http.Request) error {
+	c := newContext(r)
+	uploads, err := userUploads(c, currentUser(r))
+	if err != nil {
+		return wrapError(err, "Unable to list your uploads")
+	}
+	statuses := make([]map[string]interface{}, len(uploads))
+	for i, u := range uploads {
+		statuses[i] = uploadStatus(u)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(w).Encode(map[string]interface{}{"uploads": statuses})
+}
+
+// uploadTaskHandler sends a pending upload to the Mirror API, continuing from
+// the last chunk it received. Progress is saved after each chunk. The task
+// fails while the upload can still be retried so that the Task Queue runs it
+// again later, and hands over to a new task when it has run for
+// resumableTaskBudget.
+func uploadTaskHandler(w http.ResponseWriter, r *http.Request) error {
+	c := newContext(r)
+	userId := r.FormValue("userId")
+	id, err := strconv.ParseInt(r.FormValue("uploadId"), 10, 64)
+	if err != nil {
+		c.Errorf("Invalid upload ID: %s", r.FormValue("uploadId"))
+		return nil
+	}
+	key := uploadKey(c, userId, id)
+	u := new(ResumableUpload)
+	if err = datastore.Get(c, key, u); err == datastore.ErrNoSuchEntity {
+		c.Infof("Upload %d was canceled", id)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Unable to retrieve upload: %s", err)
+	}
+	u.ID = id
+	if u.Status != uploadPending {
+		return nil
+	}
+	t := authTransport(c, userId)
+	if t == nil {
+		c.Errorf("Unknown user ID: %s", userId)
+		return nil
+	}
+
+	start := time.Now()
+	item, err := sendUpload(c, t, key, u, start.Add(resumableTaskBudget))
+	if err == errUploadPaused {
+		if err = putUpload(c, key, u); err == nil {
+			return enqueueUpload(c, userId, id)
+		} else if err != errUploadCanceled {
+			return fmt.Errorf("Unable to store upload: %s", err)
+		}
+	}
+	if err == errUploadCanceled {
+		c.Infof("Upload %d was canceled", id)
+		return nil
+	}
+	e := &AuditEntry{Actor: actorTask, UserId: userId, Operation: "upload.resumable"}
+	if err != nil {
+		c.Errorf("Upload %d failed: %s", id, err)
+		u.Attempts++
+		u.LastError = userMessage(wrapError(err, "Unable to send "+u.Name))
+		audit(c, e, err, time.Since(start))
+		if u.Attempts >= resumableMaxAttempts {
+			u.Status = uploadFailed
+			pushFlash(c, userId, flashError, u.LastError)
+		}
+		if err := putUpload(c, key, u); err == errUploadCanceled {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Unable to store upload: %s", err)
+		}
+		if u.Status == uploadPending {
+			return errors.New("The upload will be retried")
+		}
+		return nil
+	}
+
+	u.Status, u.ItemId, u.LastError = uploadDone, item.Id, ""
+	e.Resources = []string{item.Id}
+	audit(c, e, nil, time.Since(start))
+	if err = putUpload(c, key, u); err == errUploadCanceled {
+		c.Infof("Upload %d was canceled after it was sent", id)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Unable to store upload: %s", err)
+	}
+	if err = deleteUploadChunks(c, key); err != nil {
+		c.Errorf("Unable to delete uploaded file: %s", err)
+	}
+	invalidateDashboard(c, userId)
+	pushFlash(c, userId, flashSuccess, fmt.Sprintf("%s has been sent to your Glass.", u.Name))
+	return nil
+}
+
+// putUpload stores the progress of an upload. It returns errUploadCanceled
+// rather than bring back an upload the user canceled meanwhile.
+func putUpload(c appengine.Context, key *datastore.Key, u *ResumableUpload) error {
+	u.Updated = time.Now()
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		stored := new(ResumableUpload)
+		err := datastore.Get(tc, key, stored)
+		if err == datastore.ErrNoSuchEntity || err == nil && stored.Status == uploadCanceled {
+			return errUploadCanceled
+		}
+		if err != nil {
+			return err
+		}
+		_, err = datastore.Put(tc, key, u)
+		return err
+	}, nil)
+}
+
+// sendUpload starts or resumes sending an upload until it is done, an error
+// that can't be retried right away occurs, or the deadline passes, in which
+// case it returns errUploadPaused. u.Offset is kept up to date and saved after
+// each chunk.
+func sendUpload(c appengine.Context, t http.RoundTripper, key *datastore.Key, u *ResumableUpload, deadline time.Time) (*mirror.TimelineItem, error) {
+	if u.SessionURI == "" {
+		err := mirrorCall(c, "timeline.insert", func() error {
+			return startUploadSession(t, u)
+		})
+		if err != nil {
+			return nil, err
+		}
+		u.Offset = 0
+		if err = putUpload(c, key, u); err != nil {
+			return nil, err
+		}
+	}
+
+	// After a failed request, the bytes the API received are unknown until
+	// it is asked for them.
+	resync := u.Offset > 0
+	for {
+		if time.Now().After(deadline) {
+			return nil, errUploadPaused
+		}
+		chunk := new(UploadChunk)
+		i := u.Offset / resumableChunkSize
+		if err := datastore.Get(c, datastore.NewKey(c, "UploadChunk", "", i+1, key), chunk); err != nil {
+			return nil, err
+		}
+		// Resending from the offset the API reports is safe, so chunks are
+		// retried like idempotent calls. Only the requests are repeated.
+		var item *mirror.TimelineItem
+		err := mirrorCall(c, "timeline.upload", func() (err error) {
+			if resync {
+				if item, err = sendChunk(t, u, nil); err != nil {
+					return err
+				}
+				resync = false
+				if item != nil || u.Offset/resumableChunkSize != i {
+					// Done, or the API expects bytes of another chunk.
+					return nil
+				}
+			}
+			item, err = sendChunk(t, u, chunk.Data[u.Offset-i*resumableChunkSize:])
+			resync = err != nil
+			return err
+		})
+		if err == errUploadExpired {
+			u.SessionURI, u.Offset = "", 0
+		}
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			return item, nil
+		}
+		if err = putUpload(c, key, u); err == errUploadCanceled {
+			return nil, err
+		} else if err != nil {
+			c.Errorf("Unable to store upload progress: %s", err)
+		}
+	}
+}
+
+// startUploadSession asks the Mirror API for the URI to send the upload to,
+// along with the card it is inserted with.
+func startUploadSession(t http.RoundTripper, u *ResumableUpload) error {
+	body, err := json.Marshal(&mirror.TimelineItem{
+		Text:         u.Text,
+		Notification: &mirror.NotificationConfig{Level: "AUDIO_ONLY"},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", resumableEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", u.ContentType)
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(u.Size, 10))
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = googleapi.CheckResponse(resp); err != nil {
+		return err
+	}
+	if u.SessionURI = resp.Header.Get("Location"); u.SessionURI == "" {
+		return errors.New("No upload URI was returned")
+	}
+	return nil
+}
+
+// sendChunk sends the data that follows u.Offset, or asks which bytes the API
+// received if data is nil, and updates u.Offset. It returns the inserted card
+// once the whole file has been received.
+func sendChunk(t http.RoundTripper, u *ResumableUpload, data []byte) (*mirror.TimelineItem, error) {
+	req, err := http.NewRequest("PUT", u.SessionURI, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", u.Size))
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", u.Offset, u.Offset+int64(len(data))-1, u.Size))
+	}
+	req.ContentLength = int64(len(data))
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 308: // Resume Incomplete.
+		// The Range header gives the bytes received, if any: "bytes=0-<last>".
+		u.Offset = 0
+		if rg := resp.Header.Get("Range"); rg != "" {
+			i := strings.LastIndex(rg, "-")
+			last, err := strconv.ParseInt(rg[i+1:], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid range received: %q", rg)
+			}
+			u.Offset = last + 1
+		}
+		return nil, nil
+	case http.StatusNotFound, http.StatusGone:
+		return nil, errUploadExpired
+	}
+	if err = googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	item := new(mirror.TimelineItem)
+	if err = json.NewDecoder(resp.Body).Decode(item); err != nil {
+		return nil, err
+	}
+	u.Offset = u.Size
+	return item, nil
+}
+
+// retryUpload resets a failed upload of the current user and sends it again.
+func retryUpload(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
+	userId := currentUser(r)
+	id, err := strconv.ParseInt(r.FormValue("uploadId"), 10, 64)
+	if err != nil {
+		return nil, badRequest("Invalid upload ID.")
+	}
+	key := uploadKey(c, userId, id)
+	u := new(ResumableUpload)
+	if err = datastore.Get(c, key, u); err != nil {
+		return nil, wrapError(err, "Unable to retrieve the upload")
+	}
+	if u.Status != uploadFailed {
+		return nil, nil
+	}
+	u.Status, u.Attempts = uploadPending, 0
+	if err = putUpload(c, key, u); err != nil {
+		return nil, wrapError(err, "Unable to store the upload")
+	}
+	if err = enqueueUpload(c, userId, id); err != nil {
+		return nil, wrapError(err, "Unable to restart the upload")
+	}
+	return done("%s is being sent to your Glass again.", u.Name), nil
+}
+
+// cancelUpload stops one of the current user's uploads and removes it. The
+// upload is marked canceled first so that a running task can't store it again.
+func cancelUpload(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
+	id, err := strconv.ParseInt(r.FormValue("uploadId"), 10, 64)
+	if err != nil {
+		return nil, badRequest("Invalid upload ID.")
+	}
+	key := uploadKey(c, currentUser(r), id)
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		u := new(ResumableUpload)
+		if err := datastore.Get(tc, key, u); err != nil {
+			return err
+		}
+		u.Status, u.Updated = uploadCanceled, time.Now()
+		_, err := datastore.Put(tc, key, u)
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrapError(err, "Unable to cancel the upload")
+	}
+	if err = deleteUploadChunks(c, key); err != nil {
+		return nil, wrapError(err, "Unable to cancel the upload")
+	}
+	if err = datastore.Delete(c, key); err != nil {
+		return nil, wrapError(err, "Unable to cancel the upload")
+	}
+	return nil, nil
+}
@@ -0,0 +1,111 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.google.com/p/google-api-go-client/googleapi"
+
+	"appengine"
+)
+
+// Reasons given by the API for 403 errors that are worth retrying, since the
+// call was rejected because of rate limits.
+var retryableReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+}
+
+// mirrorCall runs an API call, retrying transient failures with exponential
+// backoff and jitter until retryMaxAttempts or retryBudget is reached. The
+// call must be safe to repeat, so media readers have to be created inside it.
+// Calls named op that create resources are only retried when the API rejected
+// them, see idempotent.
+func mirrorCall(c appengine.Context, op string, call func() error) error {
+	giveUp := time.Now().Add(retryBudget)
+	backoff := retryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || !retryable(err, idempotent(op)) || attempt >= retryMaxAttempts {
+			return err
+		}
+		// Wait between half and one and a half times the backoff.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		if time.Now().Add(wait).After(giveUp) {
+			return err
+		}
+		c.Warningf("Retrying %s in %v after attempt %d failed: %s", op, wait, attempt, err)
+		countRetry(c, op)
+		time.Sleep(wait)
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// idempotent reports whether repeating the call named op can't create a
+// resource twice. Batches that may hold inserts are named "batch.insert".
+func idempotent(op string) bool {
+	return !strings.HasSuffix(op, ".insert")
+}
+
+// retryable reports whether an API call that failed with err may succeed if
+// repeated. After a server error or a timeout the call may have been carried
+// out anyway, so calls that aren't idempotent are only retried when the API
+// rejected them because of rate limits. Unknown errors aren't retried.
+func retryable(err error, idempotent bool) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	if e, ok := err.(*googleapi.Error); ok {
+		if e.Code == 429 || rateLimited(e) {
+			return true
+		}
+		return idempotent && e.Code >= http.StatusInternalServerError
+	}
+	if !idempotent {
+		return false
+	}
+	if appengine.IsTimeoutError(err) {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && (ne.Timeout() || ne.Temporary())
+}
+
+// rateLimited reports whether the API rejected a call with a 403 because of
+// rate limits.
+func rateLimited(e *googleapi.Error) bool {
+	if e.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range e.Errors {
+		if retryableReasons[item.Reason] {
+			return true
+		}
+	}
+	return false
+}
+
+// countRetry records a retry of op.
+func countRetry(c appengine.Context, op string) {
+	mirrorRetries.inc(c, op)
+}
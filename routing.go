@@ -0,0 +1,420 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.google.com/p/google-api-go-client/mirror/v1"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/urlfetch"
+)
+
+// Text the reply pipeline prefixes shared items with by default.
+const defaultReplyText = "Go Quick Start got your photo!"
+
+// sharedItem is an item the user shared with one of the app's contacts, being
+// run through the contact's pipeline. The request holds the user's details as
+// for authenticated handlers.
+type sharedItem struct {
+	Request *http.Request
+	UserId  string
+	Item    *mirror.TimelineItem
+	Route   *ContactRoute
+	Audit   *AuditEntry
+}
+
+// sharePipeline processes the items shared with a contact.
+type sharePipeline struct {
+	Name  string
+	Label string // Shown on /contacts.
+	run   func(c appengine.Context, s *sharedItem) error
+}
+
+// Pipelines contacts can be bound to. Contacts that aren't bound to any use
+// the first one.
+var pipelines = []*sharePipeline{
+	{"reply", "Reply with a message", replyPipeline},
+	{"archive", "Archive the item", archivePipeline},
+	{"processImage", "Send back processed pictures", processImagePipeline},
+	{"webhook", "Forward to a webhook", webhookPipeline},
+}
+
+// findPipeline returns the pipeline with the name, or nil.
+func findPipeline(name string) *sharePipeline {
+	for _, p := range pipelines {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// ContactRoute binds one of the user's contacts to a pipeline. Routes are
+// stored under a ContactRoutes key per user, with the contact ID as key name.
+type ContactRoute struct {
+	Pipeline      string
+	ReplyText     string `datastore:",noindex"`
+	WebhookURL    string `datastore:",noindex"`
+	WebhookSecret string `datastore:",noindex"` // Signs webhook requests if set.
+	Host          string // Host the route was set on, used to build links.
+	Updated       time.Time
+}
+
+// contactRoutesKey returns the parent key of the user's routes.
+func contactRoutesKey(c appengine.Context, userId string) *datastore.Key {
+	return datastore.NewKey(c, "ContactRoutes", userId, 0, nil)
+}
+
+// contactRoutes returns the user's routes by contact ID.
+func contactRoutes(c appengine.Context, userId string) (map[string]*ContactRoute, error) {
+	var routes []*ContactRoute
+	keys, err := datastore.NewQuery("ContactRoute").Ancestor(contactRoutesKey(c, userId)).GetAll(c, &routes)
+	if err != nil {
+		return nil, err
+	}
+	byContact := make(map[string]*ContactRoute)
+	for i, k := range keys {
+		byContact[k.StringID()] = routes[i]
+	}
+	return byContact, nil
+}
+
+// contactRoute returns the route of one of the user's contacts, or the
+// default route if it has none.
+func contactRoute(c appengine.Context, userId, contactId string) (*ContactRoute, error) {
+	route := &ContactRoute{Pipeline: pipelines[0].Name}
+	if contactId == "" {
+		return route, nil
+	}
+	err := datastore.Get(c, datastore.NewKey(c, "ContactRoute", contactId, 0, contactRoutesKey(c, userId)), route)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	return route, nil
+}
+
+// deleteContactRoutes removes all the user's routes and archived items.
+func deleteContactRoutes(c appengine.Context, userId string) error {
+	for _, parent := range []*datastore.Key{contactRoutesKey(c, userId), archiveKey(c, userId)} {
+		keys, err := datastore.NewQuery("").Ancestor(parent).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		if err = datastore.DeleteMulti(c, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeSharedItem runs an item shared by the user through the pipeline of
+// each contact it was shared with. Items shared with none of the user's
+// contacts go through the default pipeline.
+func routeSharedItem(c appengine.Context, r *http.Request, userId string, item *mirror.TimelineItem, e *AuditEntry) error {
+	var contactIds []string
+	seen := make(map[string]bool)
+	for _, ct := range item.Recipients {
+		if ct.Id != "" && !seen[ct.Id] {
+			seen[ct.Id] = true
+			contactIds = append(contactIds, ct.Id)
+		}
+	}
+	if contactIds == nil {
+		contactIds = []string{""}
+	}
+	var failed []string
+	for _, id := range contactIds {
+		route, err := contactRoute(c, userId, id)
+		if err != nil {
+			return fmt.Errorf("Unable to retrieve the route of contact %s: %s", id, err)
+		}
+		p := findPipeline(route.Pipeline)
+		if p == nil {
+			c.Errorf("Unknown pipeline %q for contact %s", route.Pipeline, id)
+			p = pipelines[0]
+		}
+		c.Infof("Routing item %s shared with %q to %s", item.Id, id, p.Name)
+		s := &sharedItem{Request: r, UserId: userId, Item: item, Route: route, Audit: e}
+		if err = p.run(c, s); err != nil {
+			c.Errorf("Pipeline %s failed for contact %s: %s", p.Name, id, err)
+			failed = append(failed, fmt.Sprintf("%s: %s", p.Name, err))
+		}
+	}
+	if failed != nil {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// replyPipeline prefixes the item's text with the route's reply.
+func replyPipeline(c appengine.Context, s *sharedItem) error {
+	reply := s.Route.ReplyText
+	if reply == "" {
+		reply = defaultReplyText
+	}
+	// We could have just updated the Text attribute in-place and used the
+	// Update method instead, but we wanted to illustrate the Patch method
+	// here.
+	patch := &mirror.TimelineItem{
+		Text: fmt.Sprintf("%s %s", reply, s.Item.Text),
+	}
+	return mirrorCall(c, "timeline.patch", func() error {
+		_, err := currentService(s.Request).Timeline.Patch(s.Item.Id, patch).Do()
+		return err
+	})
+}
+
+// ArchivedItem is a copy of an item shared with a contact bound to the archive
+// pipeline. Items are stored under an Archive key per user with the item ID as
+// key name, and their attachments of at most archiveMaxBytes as
+// ArchivedAttachment entities under them.
+type ArchivedItem struct {
+	ContactIds  []string
+	Text        string   `datastore:",noindex"`
+	Attachments []string `datastore:",noindex"` // IDs of all the attachments.
+	Shared      time.Time
+}
+
+// ArchivedAttachment is the content of an archived attachment.
+type ArchivedAttachment struct {
+	ContentType string
+	Data        []byte
+}
+
+// archiveKey returns the parent key of the user's archived items.
+func archiveKey(c appengine.Context, userId string) *datastore.Key {
+	return datastore.NewKey(c, "Archive", userId, 0, nil)
+}
+
+// pipelineAttachment downloads an attachment of the shared item for a
+// pipeline. Attachments that are still being processed or larger than max
+// bytes are skipped with a warning and returned as nil; only failures to
+// retrieve them are errors.
+func pipelineAttachment(c appengine.Context, s *sharedItem, attachmentId string, max int) (*cachedAttachment, error) {
+	hash := attachmentHash(s.UserId, s.Item.Id, attachmentId)
+	info, err := attachmentInfo(c, s.Request, hash, s.Item.Id, attachmentId)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsProcessingContent {
+		c.Warningf("Attachment %s is still being processed and was skipped", attachmentId)
+		return nil, nil
+	}
+	body, ct, err := openAttachment(c, s.Request, hash, s.Item.Id, attachmentId)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(body, int64(max)+1))
+	if err != nil {
+		return nil, wrapError(err, "Unable to download the attachment")
+	}
+	if len(data) > max {
+		c.Warningf("Attachment %s is larger than %d bytes and was skipped", attachmentId, max)
+		return nil, nil
+	}
+	return &cachedAttachment{ct, data}, nil
+}
+
+// archivePipeline copies the item and its small attachments to the datastore.
+func archivePipeline(c appengine.Context, s *sharedItem) error {
+	key := datastore.NewKey(c, "ArchivedItem", s.Item.Id, 0, archiveKey(c, s.UserId))
+	a := &ArchivedItem{Text: s.Item.Text, Shared: time.Now()}
+	for _, ct := range s.Item.Recipients {
+		a.ContactIds = append(a.ContactIds, ct.Id)
+	}
+	for _, att := range s.Item.Attachments {
+		a.Attachments = append(a.Attachments, att.Id)
+		content, err := pipelineAttachment(c, s, att.Id, archiveMaxBytes)
+		if err != nil {
+			return err
+		}
+		if content == nil {
+			continue
+		}
+		ak := datastore.NewKey(c, "ArchivedAttachment", att.Id, 0, key)
+		if _, err = datastore.Put(c, ak, &ArchivedAttachment{content.ContentType, content.Data}); err != nil {
+			return err
+		}
+	}
+	if _, err := datastore.Put(c, key, a); err != nil {
+		return err
+	}
+	s.Audit.Resources = append(s.Audit.Resources, key.Encode())
+	return nil
+}
+
+// processImagePipeline sends back a card with a black and white copy of each
+// picture attached to the item. Pictures that can't be processed are skipped.
+func processImagePipeline(c appengine.Context, s *sharedItem) error {
+	var media []*upload
+	for _, att := range s.Item.Attachments {
+		if !strings.HasPrefix(att.ContentType, "image/") {
+			continue
+		}
+		content, err := pipelineAttachment(c, s, att.Id, uploadMaxBytes)
+		if err != nil {
+			return err
+		}
+		if content == nil {
+			continue
+		}
+		src, _, err := decodePicture(content.Data)
+		if err != nil {
+			c.Warningf("Picture %s can't be processed: %s", att.Id, err)
+			continue
+		}
+		src = scaleDown(src, thumbnailSizes["large"])
+		gray := image.NewGray(src.Bounds())
+		draw.Draw(gray, gray.Bounds(), src, src.Bounds().Min, draw.Src)
+		var buf bytes.Buffer
+		if err = jpeg.Encode(&buf, gray, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return err
+		}
+		media = append(media, &upload{Name: att.Id, ContentType: "image/jpeg", Data: buf.Bytes()})
+	}
+	if media == nil {
+		c.Infof("Item %s has no picture to process", s.Item.Id)
+		return nil
+	}
+	body := &mirror.TimelineItem{
+		Text:         "Go Quick Start processed your photo.",
+		Notification: &mirror.NotificationConfig{Level: "DEFAULT"},
+	}
+	item, err := insertMediaItem(c, currentService(s.Request), body, media)
+	if item != nil {
+		s.Audit.Resources = append(s.Audit.Resources, item.Id)
+	}
+	return err
+}
+
+// webhookPipeline posts the item as JSON to the route's webhook, with links to
+// its attachments valid for webhookLinkMaxAge. If the route has a secret, the
+// X-Glassware-Signature header holds the hex HMAC-SHA256 of the body.
+func webhookPipeline(c appengine.Context, s *sharedItem) error {
+	u, err := url.Parse(s.Route.WebhookURL)
+	if err != nil {
+		return err
+	}
+	// The host may resolve to another address since the route was set.
+	if err = checkPublicHost(c, u); err != nil {
+		return err
+	}
+	type attachment struct {
+		Id          string `json:"id"`
+		ContentType string `json:"contentType"`
+		URL         string `json:"url"`
+	}
+	payload := struct {
+		UserId      string       `json:"userId"`
+		ItemId      string       `json:"itemId"`
+		Text        string       `json:"text"`
+		Recipients  []string     `json:"recipients"`
+		Attachments []attachment `json:"attachments"`
+	}{UserId: s.UserId, ItemId: s.Item.Id, Text: s.Item.Text}
+	for _, ct := range s.Item.Recipients {
+		payload.Recipients = append(payload.Recipients, ct.Id)
+	}
+	expires := time.Now().Add(webhookLinkMaxAge)
+	for _, a := range s.Item.Attachments {
+		link, err := shareURL(c, s.Route.Host, s.UserId, s.Item.Id, a.Id, expires)
+		if err != nil {
+			return err
+		}
+		payload.Attachments = append(payload.Attachments, attachment{a.Id, a.ContentType, link})
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Route.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(s.Route.WebhookSecret))
+		mac.Write(body)
+		req.Header.Set("X-Glassware-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := &http.Client{
+		Transport: &urlfetch.Transport{Context: c, Deadline: webhookTimeout},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return errors.New("Webhooks can't redirect")
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// routeContact binds the contact given by the "contactId" form value to the
+// pipeline given by the "pipeline" one, along with its settings.
+func routeContact(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
+	id := r.FormValue("contactId")
+	auditResource(r, id)
+	p := findPipeline(r.FormValue("pipeline"))
+	if id == "" || p == nil {
+		return nil, badRequest("Invalid contact or pipeline.")
+	}
+	route := &ContactRoute{
+		Pipeline:      p.Name,
+		ReplyText:     strings.TrimSpace(r.FormValue("replyText")),
+		WebhookURL:    strings.TrimSpace(r.FormValue("webhookUrl")),
+		WebhookSecret: r.FormValue("webhookSecret"),
+		Host:          r.Host,
+		Updated:       time.Now(),
+	}
+	if p.Name == "webhook" {
+		u, err := url.Parse(route.WebhookURL)
+		if err != nil || u.Host == "" {
+			return nil, badRequest("%q is not a valid webhook URL.", route.WebhookURL)
+		}
+		if err = checkPublicHost(c, u); err != nil {
+			return nil, err
+		}
+	}
+	key := datastore.NewKey(c, "ContactRoute", id, 0, contactRoutesKey(c, currentUser(r)))
+	if _, err := datastore.Put(c, key, route); err != nil {
+		return nil, wrapError(err, "Unable to store the pipeline")
+	}
+	return done("Items shared with %s will go to: %s.", id, strings.ToLower(p.Label)), nil
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/urlfetch"
+)
+
+const tokenInfoEndpointFmt = "https://www.googleapis.com/oauth2/v1/tokeninfo?access_token=%s"
+
+// Scopes that are not requested at sign-in, keyed by the short name used in
+// "/auth?scope=" links and in the UI.
+var incrementalScopes = map[string]string{
+	"location": locationScope,
+}
+
+// GrantedScopes records the OAuth scopes the user has granted to the app.
+type GrantedScopes struct {
+	Scopes  []string
+	Updated time.Time
+}
+
+// Operations that may be resumed after the user grants the incremental scope
+// they need.
+var resumableOperations = map[string]bool{
+	"insertSubscription": true,
+}
+
+// requiredScope returns the short name of the incremental scope needed to run
+// the operation in the form, or "" if the sign-in scopes are enough.
+func requiredScope(form url.Values) string {
+	if form.Get("operation") == "insertSubscription" &&
+		form.Get("collection") == "locations" {
+		return "location"
+	}
+	return ""
+}
+
+// fetchGrantedScopes asks the token info endpoint which scopes the access token
+// is valid for.
+func fetchGrantedScopes(c appengine.Context, accessToken string) ([]string, error) {
+	client := urlfetch.Client(c)
+	resp, err := client.Get(fmt.Sprintf(tokenInfoEndpointFmt, accessToken))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Token info returned %s", resp.Status)
+	}
+	info := struct {
+		Scope string `json:"scope"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return strings.Fields(info.Scope), nil
+}
+
+// storeGrantedScopes stores the scopes granted by the user in the datastore.
+func storeGrantedScopes(c appengine.Context, userId string, scopes []string) error {
+	key := datastore.NewKey(c, "GrantedScopes", userId, 0, nil)
+	_, err := datastore.Put(c, key, &GrantedScopes{Scopes: scopes, Updated: time.Now()})
+	return err
+}
+
+// grantedScopes returns the incremental scopes granted by the user as a set of
+// short names.
+func grantedScopes(c appengine.Context, userId string) map[string]bool {
+	granted := make(map[string]bool)
+	key := datastore.NewKey(c, "GrantedScopes", userId, 0, nil)
+	g := new(GrantedScopes)
+	if err := datastore.Get(c, key, g); err != nil {
+		if err != datastore.ErrNoSuchEntity {
+			c.Errorf("Unable to retrieve granted scopes: %v", err)
+		}
+		return granted
+	}
+	for name, scope := range incrementalScopes {
+		for _, s := range g.Scopes {
+			if s == scope {
+				granted[name] = true
+			}
+		}
+	}
+	return granted
+}
@@ -0,0 +1,257 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.google.com/p/google-api-go-client/mirror/v1"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Session is a server-side session stored in the datastore. The cookie only
+// holds the signed session ID.
+type Session struct {
+	ID         string `datastore:"-"`
+	UserId     string
+	Created    time.Time
+	LastSeen   time.Time
+	UserAgent  string `datastore:",noindex"`
+	RemoteAddr string `datastore:",noindex"`
+	Values     []byte `datastore:",noindex"` // Gob-encoded session values.
+}
+
+// expired reports whether the session has been idle or alive for too long.
+func (s *Session) expired(now time.Time) bool {
+	return now.Sub(s.LastSeen) > sessionIdleTimeout ||
+		now.Sub(s.Created) > sessionMaxLifetime
+}
+
+// datastoreStore is a sessions.Store keeping session values in the datastore.
+// Cookies are signed with a key generated on first use.
+type datastoreStore struct{}
+
+// codecs returns the codecs signing session cookies.
+func (s *datastoreStore) codecs(c appengine.Context) ([]securecookie.Codec, error) {
+	key, err := appKey(c, "session")
+	if err != nil {
+		return nil, err
+	}
+	return securecookie.CodecsFromPairs(key), nil
+}
+
+// Get returns the session cached for the request, loading it if needed.
+func (s *datastoreStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session referenced by the request's cookie, or returns a new
+// session if there is none or it has expired.
+func (s *datastoreStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	session.Options = sessionOptions(r)
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	c := newContext(r)
+	codecs, err := s.codecs(c)
+	if err != nil {
+		return session, err
+	}
+	var id string
+	if err = securecookie.DecodeMulti(name, cookie.Value, &id, codecs...); err != nil {
+		// Cookies signed with another key, or tampered with, start over.
+		c.Infof("Ignoring invalid session cookie: %v", err)
+		return session, nil
+	}
+
+	key := datastore.NewKey(c, "Session", id, 0, nil)
+	e := new(Session)
+	if err = datastore.Get(c, key, e); err == datastore.ErrNoSuchEntity {
+		return session, nil
+	} else if err != nil {
+		return session, err
+	}
+	now := time.Now()
+	if e.expired(now) {
+		datastore.Delete(c, key)
+		return session, nil
+	}
+	if err = gob.NewDecoder(bytes.NewReader(e.Values)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+
+	// Avoid a datastore write on every request.
+	if now.Sub(e.LastSeen) > sessionTouchInterval {
+		e.LastSeen = now
+		if _, err = datastore.Put(c, key, e); err != nil {
+			c.Errorf("Unable to update session: %v", err)
+		}
+	}
+	return session, nil
+}
+
+// Save stores the session in the datastore and writes its cookie. A negative
+// MaxAge deletes the session.
+func (s *datastoreStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	c := newContext(r)
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			key := datastore.NewKey(c, "Session", session.ID, 0, nil)
+			if err := datastore.Delete(c, key); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+		setSessionCookie(w, session.Name(), "", session.Options)
+		return nil
+	}
+
+	now := time.Now()
+	e := &Session{Created: now}
+	if session.ID == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+	key := datastore.NewKey(c, "Session", session.ID, 0, nil)
+	if err := datastore.Get(c, key, e); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	e.LastSeen = now
+	e.UserAgent = r.UserAgent()
+	e.RemoteAddr = r.RemoteAddr
+	e.UserId, _ = session.Values["userId"].(string)
+	var values bytes.Buffer
+	if err := gob.NewEncoder(&values).Encode(session.Values); err != nil {
+		return err
+	}
+	e.Values = values.Bytes()
+	if _, err := datastore.Put(c, key, e); err != nil {
+		return err
+	}
+
+	codecs, err := s.codecs(c)
+	if err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, codecs...)
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, session.Name(), encoded, session.Options)
+	return nil
+}
+
+// sessionOptions returns the cookie options for sessions served to the request.
+func sessionOptions(r *http.Request) *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(sessionMaxLifetime / time.Second),
+		Secure:   strings.HasPrefix(fullURL(r.Host, "/"), "https://"),
+		HttpOnly: true,
+	}
+}
+
+// setSessionCookie writes the session cookie. http.Cookie has no SameSite
+// field, so the attribute is appended by hand.
+func setSessionCookie(w http.ResponseWriter, name, value string, o *sessions.Options) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     o.Path,
+		Domain:   o.Domain,
+		MaxAge:   o.MaxAge,
+		Secure:   o.Secure,
+		HttpOnly: o.HttpOnly,
+	}
+	if o.MaxAge > 0 {
+		cookie.Expires = time.Now().Add(time.Duration(o.MaxAge) * time.Second)
+	} else if o.MaxAge < 0 {
+		cookie.Expires = time.Unix(1, 0)
+	}
+	w.Header().Add("Set-Cookie", cookie.String()+"; SameSite=Lax")
+}
+
+// newSessionID returns a random session ID.
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// sessionID returns the ID of the current session, or "" if it hasn't been
+// saved yet.
+func sessionID(r *http.Request) string {
+	session, err := store.Get(r, sessionName)
+	if err != nil {
+		return ""
+	}
+	return session.ID
+}
+
+// userSessions returns the active sessions of the user, deleting the expired
+// ones it comes across.
+func userSessions(c appengine.Context, userId string) ([]*Session, error) {
+	var all []*Session
+	keys, err := datastore.NewQuery("Session").Filter("UserId =", userId).GetAll(c, &all)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var active []*Session
+	for i, s := range all {
+		if s.expired(now) {
+			datastore.Delete(c, keys[i])
+			continue
+		}
+		s.ID = keys[i].StringID()
+		active = append(active, s)
+	}
+	return active, nil
+}
+
+// revokeSession signs out one of the current user's sessions.
+func revokeSession(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
+	userId := currentUser(r)
+	key := datastore.NewKey(c, "Session", r.FormValue("sessionId"), 0, nil)
+	s := new(Session)
+	if err := datastore.Get(c, key, s); err != nil || s.UserId != userId {
+		return nil, &appError{http.StatusNotFound, "Unknown session.", err}
+	}
+	if err := datastore.Delete(c, key); err != nil {
+		return nil, wrapError(err, "Unable to revoke session")
+	}
+	return done("The session has been signed out."), nil
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"code.google.com/p/google-api-go-client/mirror/v1"
+
+	"appengine"
+)
+
+// linkSignature returns the signature of the formatted link parameters, made
+// with the app's "share" key.
+func linkSignature(c appengine.Context, format string, args ...interface{}) (string, error) {
+	key, err := appKey(c, "share")
+	if err != nil {
+		return "", &appError{http.StatusServiceUnavailable, "Links can't be signed or checked right now.", err}
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, format, args...)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// shareSignature returns the signature of a link to a user's attachment that
+// is valid until expires.
+func shareSignature(c appengine.Context, userId, itemId, attachmentId string, expires int64) (string, error) {
+	return linkSignature(c, "%s\x00%s\x00%s\x00%d", userId, itemId, attachmentId, expires)
+}
+
+// shareURL returns a link to a user's attachment that anyone can follow until
+// expires.
+func shareURL(c appengine.Context, host, userId, itemId, attachmentId string, expires time.Time) (string, error) {
+	sig, err := shareSignature(c, userId, itemId, attachmentId, expires.Unix())
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{
+		"timelineItem": {itemId},
+		"attachment":   {attachmentId},
+		"user":         {userId},
+		"expires":      {strconv.FormatInt(expires.Unix(), 10)},
+		"sig":          {sig},
+	}
+	return fullURL(host, "/attachmentproxy") + "?" + v.Encode(), nil
+}
+
+// sharedOrAuthenticated wraps a handler for an attachment which is either
+// requested by its signed-in owner, or through a link signed by shareURL.
+// Signed links act on behalf of the user who shared them.
+func sharedOrAuthenticated(f func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	auth := authenticated(f)
+	return func(w http.ResponseWriter, r *http.Request) error {
+		sig := r.FormValue("sig")
+		if sig == "" {
+			return auth(w, r)
+		}
+		userId := r.FormValue("user")
+		expires, err := strconv.ParseInt(r.FormValue("expires"), 10, 64)
+		if err != nil {
+			return &appError{http.StatusForbidden, "This link is invalid.", nil}
+		}
+		want, err := shareSignature(newContext(r), userId, r.FormValue("timelineItem"), r.FormValue("attachment"), expires)
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal([]byte(sig), []byte(want)) {
+			return &appError{http.StatusForbidden, "This link is invalid.", nil}
+		}
+		if time.Now().Unix() > expires {
+			return &appError{http.StatusGone, "This link has expired.", nil}
+		}
+		ok, err := loadCurrentUser(r, userId)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &appError{http.StatusGone, "This link is no longer valid.", nil}
+		}
+		return f(w, r)
+	}
+}
+
+// shareAttachment creates a link to one of the current user's attachments that
+// anyone can follow for the number of hours given by the "hours" form value.
+func shareAttachment(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
+	userId := currentUser(r)
+	itemId := r.FormValue("itemId")
+	attachmentId := r.FormValue("attachmentId")
+	auditResource(r, itemId)
+	hours, err := strconv.Atoi(r.FormValue("hours"))
+	if err != nil || hours <= 0 {
+		return nil, badRequest("Invalid link duration.")
+	}
+	ttl := time.Duration(hours) * time.Hour
+	if ttl > shareLinkMaxAge {
+		return nil, badRequest("Links can't be valid for more than %d days.", shareLinkMaxAge/(24*time.Hour))
+	}
+	hash := attachmentHash(userId, itemId, attachmentId)
+	if _, err := attachmentInfo(c, r, hash, itemId, attachmentId); err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(ttl)
+	link, err := shareURL(c, r.Host, userId, itemId, attachmentId, expires)
+	if err != nil {
+		return nil, err
+	}
+	return done("Anyone with this link can see the attachment until %s: %s",
+		expires.UTC().Format("Jan 2 15:04 MST"), link), nil
+}
@@ -0,0 +1,201 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"time"
+
+	"appengine/memcache"
+)
+
+// serveThumbnail serves a thumbnail of an image attachment, of the size given
+// by the "size" form value and in the format given by the "format" one, or
+// else PNG for PNG and GIF pictures and JPEG for others. Thumbnails are cached
+// per attachment, size and format.
+func serveThumbnail(w http.ResponseWriter, r *http.Request, hash, itemId, attachmentId string) error {
+	c := newContext(r)
+	size, ok := thumbnailSizes[r.FormValue("size")]
+	if !ok {
+		return badRequest("Unknown thumbnail size %q.", r.FormValue("size"))
+	}
+	format := r.FormValue("format")
+	switch format {
+	case "":
+		format = "auto"
+	case "jpeg", "png":
+	default:
+		return badRequest("Thumbnails can only be JPEG or PNG.")
+	}
+
+	id := fmt.Sprintf("%s-%d-%s", hash, size, format)
+	etag := `"` + id + `"`
+	h := w.Header()
+	h.Set("ETag", etag)
+	ok, err := notModified(c, r, etag, hash, itemId, attachmentId)
+	if err != nil {
+		return err
+	}
+	if ok {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	key := "attachment:thumb:" + id
+	thumb := new(cachedAttachment)
+	if _, err := memcache.Gob.Get(c, key, thumb); err != nil {
+		a, err := attachmentContent(c, r, hash, itemId, attachmentId)
+		if err != nil {
+			return err
+		}
+		if thumb, err = makeThumbnail(a, size, format); err != nil {
+			return err
+		}
+		item := &memcache.Item{Key: key, Object: thumb, Expiration: thumbnailCacheExpiration}
+		if err := memcache.Gob.Set(c, item); err != nil {
+			c.Errorf("Unable to cache thumbnail: %v", err)
+		}
+	}
+	h.Set("Content-Type", thumb.ContentType)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(thumb.Data))
+	return nil
+}
+
+// makeThumbnail scales the image down to fit in a size by size square and
+// encodes it in the format, choosing one from the picture's if it is "auto".
+func makeThumbnail(a *cachedAttachment, size int, format string) (*cachedAttachment, error) {
+	src, srcFormat, err := decodePicture(a.Data)
+	if err != nil {
+		return nil, err
+	}
+	if format == "auto" {
+		format = "jpeg"
+		if srcFormat == "png" || srcFormat == "gif" {
+			format = "png"
+		}
+	}
+	dst := scaleDown(src, size)
+	var buf bytes.Buffer
+	thumb := &cachedAttachment{ContentType: "image/" + format}
+	if format == "png" {
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: thumbnailQuality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	thumb.Data = buf.Bytes()
+	return thumb, nil
+}
+
+// decodePicture decodes a JPEG, PNG or GIF picture of at most
+// thumbnailMaxPixels and returns it with its format.
+func decodePicture(data []byte) (image.Image, string, error) {
+	// Check the dimensions first so that huge pictures aren't decoded.
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", &appError{http.StatusUnsupportedMediaType, "Only JPEG, PNG and GIF pictures can be resized.", err}
+	}
+	if config.Width*config.Height > thumbnailMaxPixels {
+		return nil, "", badRequest("The picture is too large to be resized.")
+	}
+	m, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", &appError{http.StatusUnsupportedMediaType, "Only JPEG, PNG and GIF pictures can be resized.", err}
+	}
+	return m, format, nil
+}
+
+// scaleDown returns the image scaled to fit in a size by size square, keeping
+// its aspect ratio. Each pixel is the average of the source pixels it covers,
+// in premultiplied RGBA so that transparent pixels don't bleed their color.
+// Images that already fit are returned unchanged.
+func scaleDown(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw <= size && sh <= size {
+		return src
+	}
+	dw, dh := size, sh*size/sw
+	if sh > sw {
+		dw, dh = sw*size/sh, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	at := premultipliedAt(src)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*sh/dh, b.Min.Y+(y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*sw/dw, b.Min.X+(x+1)*sw/dw
+			var r, g, bl, al, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := at(sx, sy)
+					r, g, bl, al = r+pr, g+pg, bl+pb, al+pa
+					n++
+				}
+			}
+			if n > 0 {
+				i := dst.PixOffset(x, y)
+				dst.Pix[i+0] = uint8(r / n)
+				dst.Pix[i+1] = uint8(g / n)
+				dst.Pix[i+2] = uint8(bl / n)
+				dst.Pix[i+3] = uint8(al / n)
+			}
+		}
+	}
+	return dst
+}
+
+// premultipliedAt returns a function reading the 8-bit premultiplied RGBA
+// color of the image's pixels. The images decoded from JPEG and PNG pictures
+// are read from their Pix slices rather than through At, which allocates.
+func premultipliedAt(src image.Image) func(x, y int) (r, g, b, a uint32) {
+	switch m := src.(type) {
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			r, g, b := color.YCbCrToRGB(m.Y[m.YOffset(x, y)], m.Cb[m.COffset(x, y)], m.Cr[m.COffset(x, y)])
+			return uint32(r), uint32(g), uint32(b), 0xff
+		}
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := m.Pix[m.PixOffset(x, y):]
+			return uint32(p[0]), uint32(p[1]), uint32(p[2]), uint32(p[3])
+		}
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := m.Pix[m.PixOffset(x, y):]
+			a := uint32(p[3])
+			return uint32(p[0]) * a / 0xff, uint32(p[1]) * a / 0xff, uint32(p[2]) * a / 0xff, a
+		}
+	}
+	return func(x, y int) (uint32, uint32, uint32, uint32) {
+		r, g, b, a := src.At(x, y).RGBA()
+		return r >> 8, g >> 8, b >> 8, a >> 8
+	}
+}
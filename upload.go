@@ -0,0 +1,209 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"time"
+
+	"code.google.com/p/google-api-go-client/mirror/v1"
+
+	"appengine"
+)
+
+// Media types accepted for uploads, as detected by http.DetectContentType.
+var mediaTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+	"video/mp4":  true,
+	"video/webm": true,
+	"video/3gpp": true,
+	"audio/mpeg": true,
+	"audio/mp4":  true,
+	"audio/wave": true,
+}
+
+// upload is a media file sent by the user.
+type upload struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// mediaReader reads the content of an upload. It implements
+// googleapi.ContentTyper so that the API client sends the type checked by
+// readMedia instead of sniffing its own.
+type mediaReader struct {
+	*bytes.Reader
+	contentType string
+}
+
+func (m *mediaReader) ContentType() string {
+	return m.contentType
+}
+
+// reader returns a new reader of the upload's content.
+func (u *upload) reader() io.Reader {
+	return &mediaReader{bytes.NewReader(u.Data), u.ContentType}
+}
+
+// Because App Engine owns main and starts the HTTP service,
+// we do our setup during initialization.
+func init() {
+	http.HandleFunc("/api/upload", instrumented("upload", errorAdapter(authenticated(uploadHandler))))
+}
+
+// readUpload reads a media file of at most uploadMaxBytes, checking its size
+// and type.
+func readUpload(name, declared string, r io.Reader) (*upload, error) {
+	return readMedia(name, declared, r, uploadMaxBytes)
+}
+
+// readMedia reads a media file of at most max bytes, checking its size and
+// type. The type is sniffed from the content; the declared one is only used
+// for types that can't be sniffed.
+func readMedia(name, declared string, r io.Reader, max int) (*upload, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, wrapError(err, "Unable to read "+name)
+	}
+	if len(data) == 0 {
+		return nil, badRequest("%s is empty.", name)
+	}
+	if len(data) > max {
+		return nil, badRequest("%s is larger than %d MB.", name, max>>20)
+	}
+	ct := http.DetectContentType(data)
+	if ct == "application/octet-stream" {
+		ct, _, _ = mime.ParseMediaType(declared)
+	}
+	if !mediaTypes[ct] {
+		return nil, badRequest("%s is not a supported image, video or audio file.", name)
+	}
+	return &upload{Name: name, ContentType: ct, Data: data}, nil
+}
+
+// formUploads returns the files of the "media" field of a multipart form.
+func formUploads(r *http.Request) ([]*upload, error) {
+	if r.MultipartForm == nil {
+		return nil, nil
+	}
+	files := r.MultipartForm.File["media"]
+	if len(files) > uploadMaxFiles {
+		return nil, badRequest("At most %d files can be attached to a card.", uploadMaxFiles)
+	}
+	var uploads []*upload
+	for _, fh := range files {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, wrapError(err, "Unable to read "+fh.Filename)
+		}
+		u, err := readUpload(fh.Filename, fh.Header.Get("Content-Type"), f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, nil
+}
+
+// insertMediaItem inserts the item with the first file as its media, then
+// adds the other files as attachments. The item is returned along with the
+// error if some attachments couldn't be added.
+func insertMediaItem(c appengine.Context, svc *mirror.Service, body *mirror.TimelineItem, media []*upload) (*mirror.TimelineItem, error) {
+	var item *mirror.TimelineItem
+	err := mirrorCall(c, "timeline.insert", func() (err error) {
+		call := svc.Timeline.Insert(body)
+		if len(media) > 0 {
+			call = call.Media(media[0].reader())
+		}
+		item, err = call.Do()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(media); i++ {
+		var a *mirror.Attachment
+		err := mirrorCall(c, "timeline.attachments.insert", func() (err error) {
+			a, err = svc.Timeline.Attachments.Insert(item.Id).Media(media[i].reader()).Do()
+			return
+		})
+		if err != nil {
+			return item, err
+		}
+		item.Attachments = append(item.Attachments, a)
+	}
+	return item, nil
+}
+
+// uploadHandler inserts a card with the media files posted to it, either as
+// the "media" files of a multipart form with an optional "text" field, or as
+// the request body. It responds with the inserted item as JSON.
+func uploadHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return &appError{http.StatusMethodNotAllowed, "Uploads must be POSTed.", nil}
+	}
+	c := newContext(r)
+	userId := currentUser(r)
+	r.Body = http.MaxBytesReader(w, r.Body, uploadMaxRequest)
+	body := &mirror.TimelineItem{
+		Notification: &mirror.NotificationConfig{Level: "AUDIO_ONLY"},
+	}
+
+	var media []*upload
+	var err error
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "multipart/form-data" {
+		if err = r.ParseMultipartForm(uploadMaxMemory); err != nil {
+			return badRequest("Invalid form: %s", err)
+		}
+		body.Text = r.FormValue("text")
+		media, err = formUploads(r)
+	} else {
+		var u *upload
+		if u, err = readUpload("The request body", ct, r.Body); err == nil {
+			media = []*upload{u}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(media) == 0 {
+		return badRequest("No media file was sent.")
+	}
+
+	start := time.Now()
+	item, err := insertMediaItem(c, currentService(r), body, media)
+	e := &AuditEntry{Actor: userId, UserId: userId, Operation: "api.upload"}
+	if item != nil {
+		e.Resources = []string{item.Id}
+		invalidateDashboard(c, userId)
+	}
+	audit(c, e, err, time.Since(start))
+	if err != nil {
+		return wrapError(err, "Unable to insert the card")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(item)
+}
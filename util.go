@@ -16,10 +16,12 @@ package quickstart
 
 import (
 	"code.google.com/p/goauth2/oauth"
-	"github.com/gorilla/sessions"
+	"crypto/rand"
+	"github.com/gorilla/context"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"appengine"
@@ -27,8 +29,51 @@ import (
 	"appengine/urlfetch"
 )
 
-// Cookie store used to store the user's ID in the current session.
-var store = sessions.NewCookieStore([]byte(secret))
+// Datastore-backed store used to store the user's ID in the current session.
+var store = &datastoreStore{}
+
+// AppKey is a random key generated the first time the app needs it, such as
+// the one signing session cookies. Keys are stored with their name as key name.
+type AppKey struct {
+	Key     []byte `datastore:",noindex"`
+	Created time.Time
+}
+
+// Keys already loaded by this instance.
+var (
+	appKeysMu sync.Mutex
+	appKeys   = make(map[string][]byte)
+)
+
+// appKey returns the key with the name, generating and storing it the first
+// time it is needed by any instance.
+func appKey(c appengine.Context, name string) ([]byte, error) {
+	appKeysMu.Lock()
+	defer appKeysMu.Unlock()
+	if k, ok := appKeys[name]; ok {
+		return k, nil
+	}
+	key := datastore.NewKey(c, "AppKey", name, 0, nil)
+	k := new(AppKey)
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		err := datastore.Get(tc, key, k)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		k.Key = make([]byte, 32)
+		if _, err = rand.Read(k.Key); err != nil {
+			return err
+		}
+		k.Created = time.Now()
+		_, err = datastore.Put(tc, key, k)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	appKeys[name] = k.Key
+	return k.Key, nil
+}
 
 type SimpleToken struct {
 	AccessToken  string
@@ -62,17 +107,30 @@ func fullURL(host, path string) string {
 	return url.String()
 }
 
-// storeUserID stores the current user's ID in the session's coookies.
+// storeUserID stores the current user's ID in the session. An empty ID ends the
+// session.
 func storeUserID(w http.ResponseWriter, r *http.Request, userId string) error {
 	session, err := store.Get(r, sessionName)
 	if err != nil {
 		return err
 	}
 	session.Values["userId"] = userId
+	if userId == "" {
+		session.Options.MaxAge = -1
+	} else if session.ID != "" {
+		// Issue a new session ID on sign-in so that an ID planted before
+		// can't be used to act as the user.
+		c := newContext(r)
+		key := datastore.NewKey(c, "Session", session.ID, 0, nil)
+		if err = datastore.Delete(c, key); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		session.ID = ""
+	}
 	return session.Save(r, w)
 }
 
-// userID retrieves the current user's ID from the session's cookies.
+// userID retrieves the current user's ID from the session.
 func userID(r *http.Request) (string, error) {
 	session, err := store.Get(r, sessionName)
 	if err != nil {
@@ -110,7 +168,28 @@ func authTransport(c appengine.Context, userID string) *oauth.Transport {
 	return &oauth.Transport{
 		Config:    config(""),
 		Token:     tok,
-		Transport: &urlfetch.Transport{Context: c},
+		Transport: newTransport(c, userID),
+	}
+}
+
+// newTransport returns the transport used for API requests made for the user.
+// It counts the requests against the user's quota, records their metrics, logs
+// them in debug mode and gives up on each request after mirrorCallDeadline.
+func newTransport(c appengine.Context, userId string) http.RoundTripper {
+	return newDeadlineTransport(c, userId, mirrorCallDeadline)
+}
+
+// newDeadlineTransport is like newTransport, with another deadline for each
+// request.
+func newDeadlineTransport(c appengine.Context, userId string, deadline time.Duration) http.RoundTripper {
+	var t http.RoundTripper = &urlfetch.Transport{Context: c, Deadline: deadline}
+	if debug {
+		t = &debugTransport{Context: c, Transport: t}
+	}
+	return &quotaTransport{
+		Context:   c,
+		UserId:    userId,
+		Transport: &metricsTransport{Context: c, Transport: t},
 	}
 }
 
@@ -120,14 +199,18 @@ func deleteCredential(c appengine.Context, userId string) error {
 	return datastore.Delete(c, key)
 }
 
-// errorAdapter executes the HTTP handler and catch the returned error.
+// errorAdapter executes the HTTP handler and catch the returned error, serving
+// an error page with the error ID instead. It also clears the values stored for
+// the request by the session store and others.
 func errorAdapter(f func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c := appengine.NewContext(r)
+		defer context.Clear(r)
+		c := newContext(r)
+		w.Header().Set(correlationHeader, correlationID(r))
 		err := f(w, r)
 		if err != nil {
 			c.Errorf("Handler returned an error: %s", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 		}
 	}
 }
@@ -0,0 +1,466 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"code.google.com/p/google-api-go-client/mirror/v1"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// vcard holds the fields of a vCard that are imported as a contact.
+type vcard struct {
+	UID       string
+	Name      string
+	Phone     string
+	Kind      string // "individual" or "group", lower case.
+	PhotoURL  string
+	Photo     []byte // Embedded photo, if any.
+	PhotoType string // Declared type of the embedded photo.
+}
+
+// ContactPhoto is a photo embedded in an imported vCard. Glass needs a URL to
+// download contact pictures from, so the app serves them. Photos are stored
+// under a ContactPhotos key per user.
+type ContactPhoto struct {
+	ContentType string
+	Data        []byte
+	Updated     time.Time
+}
+
+var (
+	errNotVCard     = errors.New("Not a vCard file")
+	invalidIDChars  = regexp.MustCompile(`[^A-Za-z0-9_.\-]+`)
+	vcardTextEscape = strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`)
+	vcardTextUnesc  = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";")
+)
+
+// Because App Engine owns main and starts the HTTP service,
+// we do our setup during initialization.
+func init() {
+	http.HandleFunc("/contacts/export", instrumented("contacts.export", errorAdapter(authenticated(exportContactsHandler))))
+	http.HandleFunc("/contacts/photo", instrumented("contacts.photo", errorAdapter(contactPhotoHandler)))
+}
+
+// parseVCards reads the vCards of a file in versions 2.1, 3.0 or 4.0. Only
+// the properties used for contacts are kept.
+func parseVCards(data []byte) ([]*vcard, error) {
+	// Unfold lines continued on the next one.
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	text = strings.Replace(strings.Replace(text, "\n ", "", -1), "\n\t", "", -1)
+
+	var cards []*vcard
+	var card *vcard
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, errNotVCard
+		}
+		params := strings.Split(line[:i], ";")
+		value := line[i+1:]
+		name := strings.ToUpper(params[0])
+		if j := strings.LastIndex(name, "."); j >= 0 {
+			name = name[j+1:] // Drop the group, as in "item1.TEL".
+		}
+		if name == "BEGIN" && strings.EqualFold(value, "VCARD") {
+			card = new(vcard)
+			continue
+		}
+		if card == nil {
+			return nil, errNotVCard
+		}
+		switch name {
+		case "END":
+			cards = append(cards, card)
+			card = nil
+		case "UID":
+			card.UID = value
+		case "FN":
+			card.Name = vcardTextUnesc.Replace(value)
+		case "N":
+			if card.Name == "" {
+				// Family name; given name; ...
+				n := splitVCardValue(value)
+				if len(n) > 1 {
+					n[0], n[1] = n[1], n[0]
+				}
+				card.Name = strings.Join(strings.Fields(strings.Join(n, " ")), " ")
+			}
+		case "TEL":
+			if card.Phone == "" {
+				card.Phone = vcardTextUnesc.Replace(strings.TrimPrefix(value, "tel:"))
+			}
+		case "KIND", "X-ADDRESSBOOKSERVER-KIND":
+			card.Kind = strings.ToLower(value)
+		case "PHOTO":
+			if err := card.setPhoto(params[1:], value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if card != nil || len(cards) == 0 {
+		return nil, errNotVCard
+	}
+	return cards, nil
+}
+
+// splitVCardValue splits a structured property value on the semicolons that
+// aren't escaped and unescapes each component.
+func splitVCardValue(value string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++ // Skip the escaped character.
+		case ';':
+			parts = append(parts, vcardTextUnesc.Replace(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, vcardTextUnesc.Replace(value[start:]))
+}
+
+// setPhoto sets the photo from the parameters and value of a PHOTO property,
+// which is a URL, a data: URI or base64 data.
+func (v *vcard) setPhoto(params []string, value string) error {
+	var encoded bool
+	for _, p := range params {
+		p = strings.ToUpper(p)
+		switch {
+		case p == "ENCODING=B" || p == "ENCODING=BASE64" || p == "BASE64":
+			encoded = true
+		case strings.HasPrefix(p, "TYPE="):
+			v.PhotoType = "image/" + strings.ToLower(p[len("TYPE="):])
+		case !strings.Contains(p, "="):
+			v.PhotoType = "image/" + strings.ToLower(p) // vCard 2.1, as in "JPEG".
+		}
+	}
+	if strings.HasPrefix(value, "data:") {
+		i := strings.Index(value, ",")
+		if i < 0 || !strings.HasSuffix(value[:i], ";base64") {
+			return errors.New("Unsupported photo data URI")
+		}
+		v.PhotoType = strings.TrimSuffix(value[len("data:"):i], ";base64")
+		value, encoded = value[i+1:], true
+	}
+	if !encoded {
+		v.PhotoURL = value
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+	if err != nil {
+		return fmt.Errorf("Invalid embedded photo: %s", err)
+	}
+	v.Photo = data
+	return nil
+}
+
+// contactID returns the ID of the Mirror contact for the vCard, made from its
+// UID or, failing that, its name as insertContact does. Exported contacts
+// have their ID as UID, so they map back to the same contact.
+func (v *vcard) contactID() string {
+	id := strings.TrimPrefix(v.UID, "urn:uuid:")
+	if id == "" {
+		id = v.Name
+	}
+	return invalidIDChars.ReplaceAllString(strings.Replace(id, " ", "_", -1), "_")
+}
+
+// writeVCard writes the contact as a vCard 4.0.
+func writeVCard(w io.Writer, ct *mirror.Contact) error {
+	bw := bufio.NewWriter(w)
+	line := func(s string) {
+		// Fold lines longer than 75 bytes, without splitting UTF-8 sequences.
+		for len(s) > 75 {
+			i := 75
+			for i > 0 && s[i]&0xC0 == 0x80 {
+				i--
+			}
+			bw.WriteString(s[:i] + "\r\n")
+			s = " " + s[i:]
+		}
+		bw.WriteString(s + "\r\n")
+	}
+	line("BEGIN:VCARD")
+	line("VERSION:4.0")
+	line("UID:" + ct.Id)
+	line("FN:" + vcardTextEscape.Replace(ct.DisplayName))
+	if ct.Type == "GROUP" {
+		line("KIND:group")
+	} else {
+		line("KIND:individual")
+	}
+	for _, u := range ct.ImageUrls {
+		line("PHOTO:" + u)
+	}
+	if uri, ok := telURI(ct.PhoneNumber); ok {
+		line("TEL;VALUE=uri:" + uri)
+	} else if ct.PhoneNumber != "" {
+		line("TEL:" + vcardTextEscape.Replace(ct.PhoneNumber))
+	}
+	line("END:VCARD")
+	return bw.Flush()
+}
+
+// telURI returns the phone number as a tel URI, with spaces turned into the
+// dashes tel URIs use as separators. Numbers with other characters, such as
+// extensions or letters, can't be written as one.
+func telURI(number string) (string, bool) {
+	s := strings.Join(strings.Fields(number), "-")
+	digits := 0
+	for i, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r == '+' && i == 0:
+		case strings.ContainsRune("-.()", r):
+		default:
+			return "", false
+		}
+	}
+	return "tel:" + s, digits > 0
+}
+
+// exportContactsHandler sends the user's contacts as a vCard 4.0 file.
+func exportContactsHandler(w http.ResponseWriter, r *http.Request) error {
+	c := newContext(r)
+	var contacts []*mirror.Contact
+	err := mirrorCall(c, "contacts.list", func() error {
+		l, err := currentService(r).Contacts.List().Do()
+		if err == nil {
+			contacts = l.Items
+		}
+		return err
+	})
+	if err != nil {
+		return wrapError(err, "Unable to list your contacts")
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/vcard; charset=utf-8")
+	h.Set("Content-Disposition", `attachment; filename="glass-contacts.vcf"`)
+	h.Set("Cache-Control", "no-store")
+	for _, ct := range contacts {
+		if err = writeVCard(w, ct); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importContacts creates or updates a contact for each vCard of the file
+// given by the "vcard" form value. Existing contacts keep their settings;
+// only their name, photo and phone number are patched.
+func importContacts(r *http.Request, svc *mirror.Service) (*operationResult, error) {
+	c := newContext(r)
+	f, fh, err := r.FormFile("vcard")
+	if err != nil {
+		return nil, badRequest("No vCard file was sent.")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, vcardMaxBytes+1))
+	f.Close()
+	if err != nil {
+		return nil, wrapError(err, "Unable to read "+fh.Filename)
+	}
+	if len(data) > vcardMaxBytes {
+		return nil, badRequest("%s is larger than %d MB.", fh.Filename, vcardMaxBytes>>20)
+	}
+	cards, err := parseVCards(data)
+	if err != nil {
+		return nil, badRequest("%s can't be read: %s.", fh.Filename, err)
+	}
+	if len(cards) > vcardMaxContacts {
+		return nil, badRequest("At most %d contacts can be imported at once.", vcardMaxContacts)
+	}
+
+	existing := make(map[string]bool)
+	err = mirrorCall(c, "contacts.list", func() error {
+		l, err := svc.Contacts.List().Do()
+		if err == nil {
+			for _, ct := range l.Items {
+				existing[ct.Id] = true
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, wrapError(err, "Unable to list your contacts")
+	}
+
+	var created, updated int
+	var failures []string
+	for _, card := range cards {
+		id := card.contactID()
+		if err := importVCard(c, r, svc, card, id, existing[id]); err != nil {
+			c.Errorf("Unable to import contact %s: %s", id, err)
+			failures = append(failures, userMessage(wrapError(err, "Unable to import "+card.Name)))
+			continue
+		}
+		auditResource(r, id)
+		if existing[id] {
+			updated++
+		} else {
+			created++
+			existing[id] = true
+		}
+	}
+	msg := fmt.Sprintf("Imported %s: %d created, %d updated.", fh.Filename, created, updated)
+	if failures != nil {
+		msg += " Some contacts couldn't be imported. " + strings.Join(failures, " ")
+		return nil, &appError{http.StatusBadRequest, msg, nil}
+	}
+	return &operationResult{Message: msg}, nil
+}
+
+// importVCard inserts the contact with the ID from the vCard, or patches it if
+// it exists. New contacts without a photo get the app's picture.
+func importVCard(c appengine.Context, r *http.Request, svc *mirror.Service, card *vcard, id string, exists bool) error {
+	if card.Name == "" || id == "" {
+		return badRequest("The contact has no name.")
+	}
+	ct := &mirror.Contact{DisplayName: card.Name, PhoneNumber: card.Phone}
+	switch card.Kind {
+	case "group":
+		ct.Type = "GROUP"
+	case "individual":
+		ct.Type = "INDIVIDUAL"
+	}
+	var err error
+	var image string
+	switch {
+	case card.Photo != nil:
+		image, err = storeContactPhoto(c, r.Host, currentUser(r), id, card)
+	case card.PhotoURL != "":
+		image, err = checkContactImage(c, r.Host, card.PhotoURL)
+	case !exists:
+		image = fullURL(r.Host, "/static/images/gopher.png")
+	}
+	if err != nil {
+		return err
+	}
+	if image != "" {
+		ct.ImageUrls = []string{image}
+	}
+
+	if exists {
+		return mirrorCall(c, "contacts.patch", func() error {
+			_, err := svc.Contacts.Patch(id, ct).Do()
+			return err
+		})
+	}
+	ct.Id = id
+	if ct.Type == "" {
+		ct.Type = "INDIVIDUAL"
+	}
+	return mirrorCall(c, "contacts.insert", func() error {
+		_, err := svc.Contacts.Insert(ct).Do()
+		return err
+	})
+}
+
+// contactPhotosKey returns the parent key of the user's contact photos.
+func contactPhotosKey(c appengine.Context, userId string) *datastore.Key {
+	return datastore.NewKey(c, "ContactPhotos", userId, 0, nil)
+}
+
+// contactPhotoSignature returns the signature of the URL of a contact photo.
+func contactPhotoSignature(c appengine.Context, userId, contactId string) (string, error) {
+	return linkSignature(c, "photo\x00%s\x00%s", userId, contactId)
+}
+
+// storeContactPhoto checks and stores the photo embedded in a vCard and
+// returns the URL Glass can download it from. The URL changes with the photo
+// so that it isn't cached.
+func storeContactPhoto(c appengine.Context, host, userId, contactId string, card *vcard) (string, error) {
+	m, err := readMedia("The photo of "+card.Name, card.PhotoType, bytes.NewReader(card.Photo), contactPhotoMaxBytes)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(m.ContentType, "image/") {
+		return "", badRequest("The photo of %s must be a picture.", card.Name)
+	}
+	p := &ContactPhoto{ContentType: m.ContentType, Data: m.Data, Updated: time.Now()}
+	if _, err = datastore.Put(c, datastore.NewKey(c, "ContactPhoto", contactId, 0, contactPhotosKey(c, userId)), p); err != nil {
+		return "", wrapError(err, "Unable to store the photo of "+card.Name)
+	}
+	sig, err := contactPhotoSignature(c, userId, contactId)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(m.Data)
+	v := url.Values{
+		"user": {userId},
+		"id":   {contactId},
+		"v":    {hex.EncodeToString(sum[:8])},
+		"sig":  {sig},
+	}
+	return fullURL(host, "/contacts/photo") + "?" + v.Encode(), nil
+}
+
+// contactPhotoHandler serves a contact photo stored by storeContactPhoto to
+// anyone with its signed URL.
+func contactPhotoHandler(w http.ResponseWriter, r *http.Request) error {
+	c := newContext(r)
+	userId, contactId := r.FormValue("user"), r.FormValue("id")
+	sig, err := contactPhotoSignature(c, userId, contactId)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(r.FormValue("sig")), []byte(sig)) {
+		return &appError{http.StatusForbidden, "This link is invalid.", nil}
+	}
+	p := new(ContactPhoto)
+	err = datastore.Get(c, datastore.NewKey(c, "ContactPhoto", contactId, 0, contactPhotosKey(c, userId)), p)
+	if err == datastore.ErrNoSuchEntity {
+		return &appError{http.StatusNotFound, "This photo doesn't exist.", nil}
+	}
+	if err != nil {
+		return wrapError(err, "Unable to retrieve the photo")
+	}
+	h := w.Header()
+	h.Set("Content-Type", p.ContentType)
+	h.Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", p.Updated, bytes.NewReader(p.Data))
+	return nil
+}
+
+// deleteContactPhotos removes all the user's contact photos.
+func deleteContactPhotos(c appengine.Context, userId string) error {
+	keys, err := datastore.NewQuery("ContactPhoto").Ancestor(contactPhotosKey(c, userId)).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(c, keys)
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2013 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickstart
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"code.google.com/p/google-api-go-client/mirror/v1"
+)
+
+func TestSplitVCardValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", []string{""}},
+		{"Doe", []string{"Doe"}},
+		{"Doe;Jane;;;", []string{"Doe", "Jane", "", "", ""}},
+		{`Doe\;Smith;Jane`, []string{"Doe;Smith", "Jane"}},
+		{`Doe\,Jr;Jane`, []string{"Doe,Jr", "Jane"}},
+		{`Back\\;Slash`, []string{`Back\`, "Slash"}},
+		{`Line\nBreak;x`, []string{"Line\nBreak", "x"}},
+		{`Trailing\`, []string{`Trailing\`}},
+	}
+	for _, tt := range tests {
+		if got := splitVCardValue(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitVCardValue(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseVCardName(t *testing.T) {
+	tests := []struct {
+		card string
+		want string
+	}{
+		{"FN:Jane Doe", "Jane Doe"},
+		{`FN:Doe\, Jane`, "Doe, Jane"},
+		{"N:Doe;Jane;;;", "Jane Doe"},
+		{`N:Doe\;Smith;Jane;;;`, "Jane Doe;Smith"},
+		{"N:Doe;;;;", "Doe"},
+	}
+	for _, tt := range tests {
+		data := "BEGIN:VCARD\r\nVERSION:4.0\r\n" + tt.card + "\r\nEND:VCARD\r\n"
+		cards, err := parseVCards([]byte(data))
+		if err != nil {
+			t.Errorf("parseVCards(%q): %v", tt.card, err)
+			continue
+		}
+		if got := cards[0].Name; got != tt.want {
+			t.Errorf("parseVCards(%q) name = %q, want %q", tt.card, got, tt.want)
+		}
+	}
+}
+
+func TestTelURI(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string
+		ok     bool
+	}{
+		{"+1 650 253 0000", "tel:+1-650-253-0000", true},
+		{"(650) 253-0000", "tel:(650)-253-0000", true},
+		{"+33.1.23.45.67.89", "tel:+33.1.23.45.67.89", true},
+		{"555-0100 ext. 12", "", false},
+		{"555,0100", "", false},
+		{"555;0100", "", false},
+		{"1+2", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := telURI(tt.number)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("telURI(%q) = %q, %v, want %q, %v", tt.number, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestVCardRoundTrip(t *testing.T) {
+	contacts := []*mirror.Contact{
+		{Id: "jane", DisplayName: "Jane Doe", PhoneNumber: "+1 650 253 0000"},
+		{Id: "team", DisplayName: "Team; A, B", Type: "GROUP"},
+		{Id: "ext", DisplayName: `Back\slash`, PhoneNumber: "555-0100; ext. 12, 3"},
+		{Id: "long", DisplayName: strings.Repeat("é", 60)},
+	}
+	var buf bytes.Buffer
+	for _, ct := range contacts {
+		if err := writeVCard(&buf, ct); err != nil {
+			t.Fatalf("writeVCard(%q): %v", ct.Id, err)
+		}
+	}
+	for _, l := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+		if len(l) > 75 {
+			t.Errorf("line longer than 75 bytes: %q", l)
+		}
+	}
+	cards, err := parseVCards(buf.Bytes())
+	if err != nil {
+		t.Fatalf("parseVCards: %v", err)
+	}
+	if len(cards) != len(contacts) {
+		t.Fatalf("parseVCards returned %d cards, want %d", len(cards), len(contacts))
+	}
+	for i, ct := range contacts {
+		card := cards[i]
+		kind := "individual"
+		if ct.Type == "GROUP" {
+			kind = "group"
+		}
+		phone := ct.PhoneNumber
+		if uri, ok := telURI(phone); ok {
+			phone = strings.TrimPrefix(uri, "tel:")
+		}
+		if card.contactID() != ct.Id || card.Name != ct.DisplayName || card.Phone != phone || card.Kind != kind {
+			t.Errorf("contact %q came back as %+v", ct.Id, card)
+		}
+	}
+}